@@ -4,14 +4,20 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
+	_ "time/tzdata" // Embed timezones for --timezone, as the container image has none
 
 	"github.com/ashleydavies/bloggernetes/internal"
 	"github.com/charmbracelet/log"
+	"golang.org/x/sync/errgroup"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
@@ -19,11 +25,35 @@ import (
 
 // Options holds the command line options for the application
 type Options struct {
-	Namespace   string
-	Kubeconfig  string
-	ContextName string
-	Addr        string
-	BlogName    string
+	Namespace      string
+	Kubeconfig     string
+	ContextName    string
+	Addr           string
+	AdminAddr      string
+	MaxWatchOutage time.Duration
+	ConfigMaps     bool
+	Shutdown       time.Duration
+	LeaderElect    bool
+	LeaseName      string
+	BlogName       string
+	CodeStyle      string
+	HTMLPolicy     string
+	MermaidURL     string
+	Mermaid        bool
+	ThemeDir       string
+	ThemeConfig    string
+	Git            internal.GitSourceOptions
+	Locale         string
+	Timezone       string
+	RenderCache    int
+	CompressMin    int
+	ImageWidths    string
+	ImageSizes     string
+	ImageCache     int
+	Security       internal.SecurityOptions
+	LogFormat      string
+	LogLevel       string
+	Tracing        internal.TracingOptions
 }
 
 // parseFlags parses the command line flags and returns the options
@@ -32,7 +62,39 @@ func parseFlags() *Options {
 
 	flag.StringVar(&opts.Namespace, "namespace", "default", "Namespace to watch for BlogPost resources")
 	flag.StringVar(&opts.Addr, "addr", ":8080", "Address to listen on for HTTP requests")
+	flag.StringVar(&opts.AdminAddr, "admin-addr", "", "Address to serve /metrics, /healthz and /readyz on, separately from the blog (empty to serve them on --addr)")
+	flag.BoolVar(&opts.ConfigMaps, "content-configmaps", true, "Allow posts, pages and assets to read their content from ConfigMaps labelled "+internal.ContentConfigMapLabel+"=true, which requires permission to list and watch ConfigMaps")
+	flag.DurationVar(&opts.MaxWatchOutage, "max-watch-outage", internal.DefaultMaxWatchOutage, "How long watches on the Kubernetes API may keep failing before /readyz reports the blog not ready")
+	flag.DurationVar(&opts.Shutdown, "shutdown-timeout", internal.DefaultShutdownTimeout, "How long requests in progress, and the rest of the blog, are given to finish when shutting down")
+	flag.BoolVar(&opts.LeaderElect, "leader-elect", false, "Elect one replica, through a Lease in the watched namespace, to write statuses to the cluster; every replica serves the blog")
+	flag.StringVar(&opts.LeaseName, "leader-election-lease", internal.DefaultLeaseName, "Name of the Lease replicas compete for when --leader-elect is set")
 	flag.StringVar(&opts.BlogName, "blog-name", "Bloggernetes", "Name of the blog")
+	flag.StringVar(&opts.CodeStyle, "code-style", internal.DefaultCodeStyle, fmt.Sprintf("Colour scheme for highlighted code, one of: %s", strings.Join(internal.CodeStyles(), ", ")))
+	flag.StringVar(&opts.HTMLPolicy, "html-policy", internal.DefaultHTMLPolicy, fmt.Sprintf("How raw HTML in posts and pages is treated, one of: %s", strings.Join(internal.HTMLPolicies(), ", ")))
+	flag.StringVar(&opts.Locale, "locale", internal.DefaultLocale, fmt.Sprintf("Locale dates are written in, one of: %s", strings.Join(internal.Locales(), ", ")))
+	flag.StringVar(&opts.Timezone, "timezone", "UTC", "IANA name of the timezone dates are written in, such as Europe/London")
+	flag.IntVar(&opts.RenderCache, "render-cache-size", internal.DefaultRenderCacheSize, "Number of rendered pages to cache until posts, pages or the theme change (0 to disable)")
+	flag.IntVar(&opts.CompressMin, "compression-min-size", internal.DefaultCompressionMinSize, "Size in bytes below which responses are sent uncompressed")
+	flag.StringVar(&opts.ImageWidths, "image-widths", internal.FormatImageWidths(internal.DefaultImageWidths), "Comma-separated widths in pixels of the resized variants offered for BlogAsset images (empty to only serve originals)")
+	flag.StringVar(&opts.ImageSizes, "image-sizes", internal.DefaultImageSizes, "Sizes attribute telling browsers how wide images are shown, to choose between the resized variants")
+	flag.IntVar(&opts.ImageCache, "image-cache-size", internal.DefaultImageCacheSize, "Megabytes of resized images kept in memory (0 to resize every request)")
+	flag.StringVar(&opts.ThemeDir, "theme-dir", "", "Directory of template and asset files overriding the built-in theme, reloaded when they change")
+	flag.StringVar(&opts.ThemeConfig, "theme-configmap", "", "Name of a ConfigMap in the watched namespace whose keys override the built-in theme's templates and assets, reloaded when it changes")
+	flag.StringVar(&opts.Git.URL, "git-url", "", "URL of a git repository, or path of a local one, to read posts, pages and assets from alongside those in the cluster (empty to disable)")
+	flag.StringVar(&opts.Git.Branch, "git-branch", "", "Branch of the git repository to read (empty for its default branch)")
+	flag.StringVar(&opts.Git.Dir, "git-dir", "", "Directory of the git repository holding posts, pages and assets (empty for its root)")
+	flag.DurationVar(&opts.Git.PollInterval, "git-poll-interval", internal.DefaultGitPollInterval, "How often the git repository is pulled for changes (0 to only pull when notified through the webhook)")
+	flag.StringVar(&opts.Git.WebhookSecret, "git-webhook-secret", os.Getenv("GIT_WEBHOOK_SECRET"), "Secret verifying push webhooks sent to /webhooks/git, defaulting to $GIT_WEBHOOK_SECRET (empty to disable the webhook)")
+	flag.StringVar(&opts.MermaidURL, "mermaid-url", "", "URL of the mermaid script used to draw diagrams, such as a CDN, which must be allowed by the Content-Security-Policy (empty to serve the bundled script)")
+	flag.BoolVar(&opts.Mermaid, "mermaid", true, "Draw mermaid diagrams, which requires the bundled script or --mermaid-url; when disabled their sources are shown")
+	flag.StringVar(&opts.Security.ContentSecurityPolicy, "content-security-policy", internal.DefaultContentSecurityPolicy, "Content-Security-Policy header, where {nonce} is replaced by each response's script nonce (empty to disable)")
+	flag.DurationVar(&opts.Security.HSTSMaxAge, "hsts-max-age", internal.DefaultHSTSMaxAge, "Max age of the Strict-Transport-Security header sent over HTTPS (0 to disable)")
+	flag.StringVar(&opts.Security.ReferrerPolicy, "referrer-policy", internal.DefaultReferrerPolicy, "Referrer-Policy header (empty to disable)")
+	flag.StringVar(&opts.Security.PermissionsPolicy, "permissions-policy", internal.DefaultPermissionsPolicy, "Permissions-Policy header (empty to disable)")
+	flag.StringVar(&opts.LogFormat, "log-format", internal.DefaultLogFormat, fmt.Sprintf("Format of log messages, one of: %s", strings.Join(internal.LogFormats(), ", ")))
+	flag.StringVar(&opts.LogLevel, "log-level", internal.DefaultLogLevel, fmt.Sprintf("Least severe level of message logged, one of: %s", strings.Join(internal.LogLevels(), ", ")))
+	flag.StringVar(&opts.Tracing.Endpoint, "otlp-endpoint", "", "URL of the OTLP/HTTP collector to export traces to, such as http://otel-collector:4318 (empty to disable tracing)")
+	flag.Float64Var(&opts.Tracing.SampleRatio, "trace-sample-ratio", internal.DefaultTraceSampleRatio, "Fraction of requests traced when no upstream sampling decision was made")
 
 	// Determine if we're running in a cluster
 	if isRunningInCluster() {
@@ -68,13 +130,19 @@ func setupSignalHandler(ctx context.Context) (context.Context, context.CancelFun
 		<-signalCh
 		log.Info("Received shutdown signal")
 		cancel()
+
+		// A second signal skips waiting for the components to stop
+		<-signalCh
+		log.Warn("Received second shutdown signal, exiting immediately")
+		os.Exit(1)
 	}()
 
 	return ctx, cancel
 }
 
-// createKubernetesClient creates a Kubernetes client based on the options
-func createKubernetesClient(opts *Options) (dynamic.Interface, error) {
+// createKubernetesClients creates the dynamic Kubernetes client used to watch resources and the
+// typed client used for leader election, based on the options
+func createKubernetesClients(opts *Options) (dynamic.Interface, kubernetes.Interface, error) {
 	var config *rest.Config
 	var err error
 
@@ -82,7 +150,7 @@ func createKubernetesClient(opts *Options) (dynamic.Interface, error) {
 		// In-cluster configuration
 		config, err = rest.InClusterConfig()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create in-cluster config: %w", err)
+			return nil, nil, fmt.Errorf("failed to create in-cluster config: %w", err)
 		}
 	} else {
 		// Out-of-cluster configuration
@@ -97,17 +165,23 @@ func createKubernetesClient(opts *Options) (dynamic.Interface, error) {
 		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
 		config, err = kubeConfig.ClientConfig()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create out-of-cluster config: %w", err)
+			return nil, nil, fmt.Errorf("failed to create out-of-cluster config: %w", err)
 		}
 	}
 
 	// Create dynamic client
 	dynamicClient, err := dynamic.NewForConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+		return nil, nil, fmt.Errorf("failed to create dynamic client: %w", err)
 	}
 
-	return dynamicClient, nil
+	// Create typed client
+	typedClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create typed client: %w", err)
+	}
+
+	return dynamicClient, typedClient, nil
 }
 
 // Components holds the application components
@@ -115,77 +189,254 @@ type Components struct {
 	Store      *internal.Store
 	Controller *internal.Controller
 	Server     *internal.Server
+	Theme      internal.ThemeSource
+	Git        *internal.GitSource
 }
 
-// createComponents creates the application components based on the options and the Kubernetes client
-func createComponents(opts *Options, client dynamic.Interface) (*Components, error) {
+// createComponents creates the application components based on the options and the Kubernetes clients
+func createComponents(opts *Options, client dynamic.Interface, typedClient kubernetes.Interface) (*Components, error) {
 	// Create store
 	store := internal.NewStore()
 
+	// Create Markdown renderer
+	imageWidths, err := internal.ParseImageWidths(opts.ImageWidths)
+	if err != nil {
+		return nil, err
+	}
+	renderer, err := internal.NewRenderer(internal.DefaultShortcodes(), opts.HTMLPolicy, internal.ImageOptions{
+		Widths: imageWidths,
+		Sizes:  opts.ImageSizes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create renderer: %w", err)
+	}
+
 	// Create controller
-	controller := internal.NewController(client, store, opts.Namespace)
+	controllerOptions := internal.ControllerOptions{
+		Namespace:         opts.Namespace,
+		ContentConfigMaps: opts.ConfigMaps,
+		MaxWatchOutage:    opts.MaxWatchOutage,
+	}
+	if opts.LeaderElect {
+		controllerOptions.LeaderElection = &internal.LeaderElectionOptions{
+			Client:    typedClient,
+			Namespace: opts.Namespace,
+			LeaseName: opts.LeaseName,
+		}
+	}
+	controller := internal.NewController(client, store, renderer, controllerOptions)
+
+	// Create git content source, if content is also read from a repository
+	var git *internal.GitSource
+	var gitWebhook http.Handler
+	if opts.Git.URL != "" {
+		if git, err = internal.NewGitSource(store, renderer, opts.Git); err != nil {
+			return nil, fmt.Errorf("failed to create git source: %w", err)
+		}
+		gitWebhook = git.Webhook()
+	}
 
 	// Create server
-	server, err := internal.NewServer(store, opts.Addr, opts.BlogName)
+	server, err := internal.NewServer(store, renderer, internal.ServerOptions{
+		Addr:       opts.Addr,
+		AdminAddr:  opts.AdminAddr,
+		Ready:      readyFunc(controller, git),
+		Leader:     leaderFunc(opts, controller),
+		GitWebhook: gitWebhook,
+		BlogName:   opts.BlogName,
+		CodeStyle:  opts.CodeStyle,
+		MermaidURL: opts.MermaidURL,
+		Mermaid:    opts.Mermaid,
+		Locale:     opts.Locale,
+		Timezone:   opts.Timezone,
+		Security:   opts.Security,
+
+		RenderCacheSize:    opts.RenderCache,
+		ImageCacheSize:     int64(opts.ImageCache) << 20,
+		CompressionMinSize: opts.CompressMin,
+		ShutdownTimeout:    opts.Shutdown,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create server: %w", err)
 	}
 
+	// Create theme source, if the built-in theme is overridden
+	var theme internal.ThemeSource
+	switch {
+	case opts.ThemeDir != "" && opts.ThemeConfig != "":
+		return nil, fmt.Errorf("only one of --theme-dir and --theme-configmap may be given")
+	case opts.ThemeDir != "":
+		if theme, err = internal.NewDirThemeSource(opts.ThemeDir); err != nil {
+			return nil, fmt.Errorf("failed to create theme source: %w", err)
+		}
+	case opts.ThemeConfig != "":
+		theme = internal.NewConfigMapThemeSource(client, opts.Namespace, opts.ThemeConfig)
+	}
+
 	return &Components{
 		Store:      store,
 		Controller: controller,
 		Server:     server,
+		Theme:      theme,
+		Git:        git,
 	}, nil
 }
 
-// startApplication starts the application components
-func startApplication(ctx context.Context, components *Components) error {
-	// Start controller in a goroutine
-	go func() {
+// readyFunc returns the function reporting why the blog is not ready to serve, which it is once the
+// controller, and the git source if there is one, have loaded their content
+func readyFunc(controller *internal.Controller, git *internal.GitSource) func() error {
+	if git == nil {
+		return controller.Ready
+	}
+	return func() error {
+		if err := controller.Ready(); err != nil {
+			return err
+		}
+		return git.Ready()
+	}
+}
+
+// leaderFunc returns the function reporting whether this replica leads the others, or nil if
+// replicas do not elect a leader
+func leaderFunc(opts *Options, controller *internal.Controller) func() bool {
+	if !opts.LeaderElect {
+		return nil
+	}
+	return controller.IsLeader
+}
+
+// runApplication runs the application components until the context is cancelled or one of them
+// fails, returning once they have all stopped. The admin server starts first, so that probes and
+// metrics are answered while the controller loads the posts and pages, and the blog only listens
+// once they have been loaded, so that it never serves an empty blog.
+func runApplication(ctx context.Context, components *Components) error {
+	// Bind the admin address before starting anything, so that a port in use fails at once
+	if err := components.Server.ListenAdmin(); err != nil {
+		return err
+	}
+
+	// Cancelled when any component fails, stopping the rest
+	group, ctx := errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		return components.Server.ServeAdmin(ctx)
+	})
+
+	group.Go(func() error {
 		if err := components.Controller.Start(ctx); err != nil {
-			log.Error("Controller error", "error", err)
+			return fmt.Errorf("controller error: %w", err)
 		}
-	}()
+		return nil
+	})
+
+	// Watch the theme, applying it to the server whenever it changes
+	if components.Theme != nil {
+		group.Go(func() error {
+			if err := components.Theme.Watch(ctx, components.Server.SetTheme); err != nil {
+				return fmt.Errorf("theme error: %w", err)
+			}
+			return nil
+		})
+	}
 
-	// Start server
-	log.Info("Starting server", "address", components.Server.Addr)
-	if err := components.Server.Start(ctx); err != nil {
-		return fmt.Errorf("server error: %w", err)
+	// Load the posts, pages and assets in the git repository, pulling it whenever it changes
+	if components.Git != nil {
+		group.Go(func() error {
+			if err := components.Git.Run(ctx); err != nil {
+				return fmt.Errorf("git source error: %w", err)
+			}
+			return nil
+		})
 	}
 
-	return nil
+	// Serve the blog once the posts and pages have been loaded
+	group.Go(func() error {
+		log.Info("Waiting for the controller to sync")
+		if err := components.Controller.WaitForSync(ctx); err != nil {
+			// Shutting down before syncing is not a failure of the server
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if components.Git != nil {
+			log.Info("Waiting for the git repository to sync")
+			if err := components.Git.WaitForSync(ctx); err != nil {
+				// Only fails when shutting down
+				return nil
+			}
+		}
+
+		if err := components.Server.Listen(); err != nil {
+			return err
+		}
+		return components.Server.Serve(ctx)
+	})
+
+	return group.Wait()
 }
 
 func main() {
 	// Parse command line flags
 	opts := parseFlags()
 
-	// Create a context that can be cancelled
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Configure logging before anything else logs
+	if err := internal.ConfigureLogging(opts.LogFormat, opts.LogLevel); err != nil {
+		log.Fatal("Invalid logging options", "error", err)
+	}
 
-	// Set up signal handling
-	ctx, cancel = setupSignalHandler(ctx)
+	// Create a context that is cancelled on shutdown signals
+	ctx, cancel := setupSignalHandler(context.Background())
 	defer cancel()
 
-	// Create Kubernetes client
-	client, err := createKubernetesClient(opts)
+	// Export traces, if a collector is configured
+	shutdownTracing, err := internal.StartTracing(ctx, opts.Tracing)
+	if err != nil {
+		log.Fatal("Failed to start tracing", "error", err)
+	}
+
+	// Create Kubernetes clients
+	client, typedClient, err := createKubernetesClients(opts)
 	if err != nil {
 		log.Fatal("Failed to create Kubernetes client", "error", err)
 	}
 
 	// Create application components
-	components, err := createComponents(opts, client)
+	components, err := createComponents(opts, client, typedClient)
 	if err != nil {
 		log.Fatal("Failed to create application components", "error", err)
 	}
 
-	// Start application
-	if err := startApplication(ctx, components); err != nil {
-		log.Fatal("Failed to start application", "error", err)
+	// Run the application in the background, so that its shutdown can be bounded
+	done := make(chan error, 1)
+	go func() {
+		done <- runApplication(ctx, components)
+	}()
+
+	// Wait for a shutdown signal or a component to fail
+	var runErr error
+	select {
+	case runErr = <-done:
+		// A component failed, and the others have stopped
+		cancel()
+	case <-ctx.Done():
+		log.Info("Shutting down gracefully...", "timeout", opts.Shutdown)
+		select {
+		case runErr = <-done:
+		case <-time.After(opts.Shutdown):
+			runErr = fmt.Errorf("timed out after %s waiting for components to stop", opts.Shutdown)
+		}
+	}
+
+	// Export the spans still buffered
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Error("Failed to flush traces", "error", err)
 	}
 
-	// Wait for context to be cancelled (e.g., by Ctrl+C)
-	<-ctx.Done()
-	log.Info("Shutting down gracefully...")
+	if runErr != nil {
+		log.Fatal("Application failed", "error", runErr)
+	}
+	log.Info("Shut down cleanly")
 }
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticDir is the directory of the embedded templates holding static assets such as stylesheets
+const staticDir = "templates/static"
+
+// staticPrefix is the URL path static assets are served beneath
+const staticPrefix = "/static/"
+
+// assetHashLength is the number of hex digits of an asset's content hash included in its path
+const assetHashLength = 12
+
+// Cache-Control values for assets requested by their content-hashed path, which never change, and
+// by their plain name, which change whenever the blog is upgraded or reconfigured
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+)
+
+// asset is a static file served by the blog
+type asset struct {
+	Name        string // The plain file name, such as style.css
+	HashedName  string // The file name including a hash of the content, such as style.0123456789ab.css
+	ETag        string
+	ContentType string
+	Content     []byte
+	Encoded     map[string][]byte // Precompressed content indexed by content coding, where smaller
+}
+
+// assets holds the blog's static assets, indexed by both their plain and content-hashed names
+type assets struct {
+	byName       map[string]*asset
+	byHashedName map[string]*asset
+	loadedAt     time.Time
+}
+
+// loadAssets loads the static assets embedded in the binary
+func loadAssets() (*assets, error) {
+	a := &assets{
+		byName:       make(map[string]*asset),
+		byHashedName: make(map[string]*asset),
+		loadedAt:     time.Now(),
+	}
+
+	err := fs.WalkDir(Templates, staticDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		content, err := Templates.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read asset %s: %w", filePath, err)
+		}
+
+		a.add(strings.TrimPrefix(filePath, staticDir+"/"), content)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load assets: %w", err)
+	}
+
+	return a, nil
+}
+
+// add adds an asset with the given name and content, replacing any existing asset with that name
+func (a *assets) add(name string, content []byte) {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])[:assetHashLength]
+
+	ext := path.Ext(name)
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	if existing, exists := a.byName[name]; exists {
+		delete(a.byHashedName, existing.HashedName)
+	}
+
+	added := &asset{
+		Name:        name,
+		HashedName:  strings.TrimSuffix(name, ext) + "." + hash + ext,
+		ETag:        `"` + hash + `"`,
+		ContentType: contentType,
+		Content:     content,
+		Encoded:     make(map[string][]byte),
+	}
+	if isCompressible(contentType) {
+		for _, encoding := range supportedEncodings {
+			if compressed, err := compress(content, encoding); err == nil && len(compressed) < len(content) {
+				added.Encoded[encoding] = compressed
+			}
+		}
+	}
+	a.byName[name] = added
+	a.byHashedName[added.HashedName] = added
+}
+
+// path returns the content-hashed URL path of the named asset, for use in templates
+func (a *assets) path(name string) (string, error) {
+	found, exists := a.byName[name]
+	if !exists {
+		return "", fmt.Errorf("unknown asset %q", name)
+	}
+	return staticPrefix + found.HashedName, nil
+}
+
+// serve serves an asset by its content-hashed or plain name, calling notFound if there is none
+func (a *assets) serve(w http.ResponseWriter, r *http.Request, notFound http.HandlerFunc) {
+	name := strings.TrimPrefix(r.URL.Path, staticPrefix)
+
+	cacheControl := immutableCacheControl
+	found, exists := a.byHashedName[name]
+	if !exists {
+		cacheControl = revalidateCacheControl
+		if found, exists = a.byName[name]; !exists {
+			notFound(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", found.ContentType)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	// Serve a precompressed variant if the client accepts one, tagged apart from the original
+	content, etag := found.Content, found.ETag
+	available := make([]string, 0, len(found.Encoded))
+	for _, encoding := range supportedEncodings {
+		if _, exists := found.Encoded[encoding]; exists {
+			available = append(available, encoding)
+		}
+	}
+	if encoding := negotiateEncoding(r, available); encoding != "" {
+		content = found.Encoded[encoding]
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, found.Name, a.loadedAt, bytes.NewReader(content))
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// blogAssetPrefix is the URL path BlogAssets are served beneath
+const blogAssetPrefix = "/assets/"
+
+// blogAssetScheme prefixes the names of BlogAssets referenced from Markdown, as in
+// ![Diagram](asset:diagram.png), which are rewritten to the URLs they are served at
+const blogAssetScheme = "asset:"
+
+// blogAssetCacheControl lets clients reuse a BlogAsset for a few minutes before revalidating it,
+// as an asset may be replaced under the same name
+const blogAssetCacheControl = "public, max-age=300"
+
+// blogAssetContentSecurityPolicy stops scripts in assets such as SVG images from running if an
+// asset is opened directly, as authors' files are served from the blog's own origin
+const blogAssetContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+
+// BlogAsset represents a file, such as an image, from the Kubernetes CRD for posts and pages to
+// reference
+type BlogAsset struct {
+	Name        string
+	ContentType string
+	Content     []byte
+	ETag        string
+	Modified    time.Time // When the asset's resource or file last changed
+}
+
+// convertToBlogAsset converts an unstructured object to a BlogAsset, reading its data inline or
+// from a ConfigMap
+func convertToBlogAsset(obj interface{}, readContent contentReader) (*BlogAsset, error) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, invalidSpec("object is not an Unstructured")
+	}
+
+	spec, found, err := unstructured.NestedMap(unstructuredObj.Object, "spec")
+	if err != nil || !found {
+		return nil, invalidSpec("spec not found in BlogAsset: %v", err)
+	}
+
+	name, _ := spec["name"].(string)
+	if name == "" || strings.Contains(name, "/") {
+		return nil, invalidSpec("invalid asset name %q", name)
+	}
+
+	var content []byte
+	ref, err := contentRefFrom(spec, "dataFrom")
+	if err != nil {
+		return nil, err
+	}
+	if ref != nil {
+		data, err := readContent(unstructuredObj.GetNamespace(), ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dataFrom: %w", err)
+		}
+		content = []byte(data)
+	} else {
+		encoded, _ := spec["data"].(string)
+		if content, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, invalidSpec("failed to decode data: %v", err)
+		}
+	}
+
+	contentType, _ := spec["contentType"].(string)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	content = stripImageMetadata(contentType, content)
+	sum := sha256.Sum256(content)
+	return &BlogAsset{
+		Name:        name,
+		ContentType: contentType,
+		Content:     content,
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Modified:    resourceModified(unstructuredObj),
+	}, nil
+}
+
+// blogAssetURL returns the URL a link to a BlogAsset is served at, reporting false for links to
+// anything else
+func blogAssetURL(destination string) (string, bool) {
+	name, isAsset := strings.CutPrefix(destination, blogAssetScheme)
+	if !isAsset || name == "" {
+		return destination, false
+	}
+	return blogAssetPrefix + url.PathEscape(name), true
+}
+
+// blogAssetLinkTransformer rewrites links and images referencing BlogAssets by name to the URLs
+// they are served at, offering resized variants of images
+type blogAssetLinkTransformer struct {
+	images ImageOptions
+}
+
+// Transform implements parser.ASTTransformer
+func (t *blogAssetLinkTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *ast.Link:
+			if rewritten, isAsset := blogAssetURL(string(n.Destination)); isAsset {
+				n.Destination = []byte(rewritten)
+			}
+		case *ast.Image:
+			rewritten, isAsset := blogAssetURL(string(n.Destination))
+			if !isAsset {
+				break
+			}
+			n.Destination = []byte(rewritten)
+			if len(t.images.Widths) > 0 && isResizableImage(mime.TypeByExtension(path.Ext(rewritten))) {
+				n.SetAttributeString("srcset", []byte(imageSrcSet(rewritten, t.images.Widths)))
+				n.SetAttributeString("sizes", []byte(t.images.Sizes))
+			}
+		}
+
+		return ast.WalkContinue, nil
+	})
+}
+
+// handleBlogAsset handles requests for BlogAssets by name, and for resized variants of images at
+// one of the offered widths with the w query parameter
+func (s *Server) handleBlogAsset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, blogAssetPrefix)
+
+	span := traceStore(r, "GetAsset", attribute.String("asset.name", name))
+	found, exists := s.store.GetAsset(name)
+	span.End()
+	if !exists {
+		s.notFound(w, r)
+		return
+	}
+
+	contentType, content, etag := found.ContentType, found.Content, found.ETag
+	if width := r.URL.Query().Get("w"); width != "" {
+		parsed, err := strconv.Atoi(width)
+		if err != nil || !slices.Contains(s.renderer.images.Widths, parsed) {
+			s.notFound(w, r)
+			return
+		}
+
+		// Variants are served in the best format the client accepts, so caches must keep them apart
+		if isResizableImage(found.ContentType) {
+			w.Header().Add("Vary", "Accept")
+			variant, err := s.images.variant(found, parsed, variantFormat(found.ContentType, r))
+			if err != nil {
+				// The original is still worth showing, if slower to load
+				log.Warn("Failed to resize image, serving the original", "asset", name, "width", parsed,
+					"error", err, "request_id", requestIDFrom(r))
+			} else {
+				contentType, content, etag = variant.ContentType, variant.Content, variant.ETag
+			}
+		}
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", blogAssetCacheControl)
+	header.Set("Content-Security-Policy", blogAssetContentSecurityPolicy)
+	header.Set("ETag", etag)
+	http.ServeContent(w, r, found.Name, found.Modified, bytes.NewReader(content))
+}
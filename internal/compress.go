@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultCompressionMinSize is the size in bytes below which responses are sent uncompressed, as
+// compressing them saves less than the overhead it adds
+const DefaultCompressionMinSize = 1024
+
+// Content codings the blog can compress responses with, in order of preference
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+// Compression levels for responses compressed as they are served, which favour speed, and for
+// static assets compressed once when loaded, which favour size
+const (
+	dynamicBrotliLevel = 5
+	dynamicGzipLevel   = gzip.DefaultCompression
+	staticBrotliLevel  = brotli.BestCompression
+	staticGzipLevel    = gzip.BestCompression
+)
+
+// Encoders are pooled as they allocate large buffers
+var (
+	brotliWriterPool = sync.Pool{
+		New: func() interface{} {
+			return brotli.NewWriterLevel(nil, dynamicBrotliLevel)
+		},
+	}
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			writer, _ := gzip.NewWriterLevel(nil, dynamicGzipLevel)
+			return writer
+		},
+	}
+)
+
+// isCompressible reports whether content of a media type benefits from compression. Images other
+// than SVG, fonts and archives are already compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding returns the most preferred of the available content codings accepted by a
+// request, or an empty string if the response should not be encoded
+func negotiateEncoding(r *http.Request, available []string) string {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" {
+		return ""
+	}
+
+	// Read the quality of each coding, where * applies to any coding not listed by name
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		quality := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if coding == "*" {
+			wildcard = quality
+		} else {
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range available {
+		quality, listed := qualities[coding]
+		if !listed {
+			quality = wildcard
+		}
+		// Ties go to the earlier, more preferred coding
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compress compresses content with a content coding for storing, such as a static asset
+func compress(content []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var encoder io.WriteCloser
+
+	switch encoding {
+	case encodingBrotli:
+		encoder = brotli.NewWriterLevel(&buf, staticBrotliLevel)
+	case encodingGzip:
+		writer, err := gzip.NewWriterLevel(&buf, staticGzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		encoder = writer
+	}
+
+	if _, err := encoder.Write(content); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compression returns a middleware compressing responses with the coding the client most prefers.
+// Responses smaller than minSize, of media types that do not compress well, or already encoded,
+// such as precompressed static assets, are sent as they are.
+func compression(minSize int) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Caches must keep compressed and uncompressed responses apart
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			encoding := negotiateEncoding(r, supportedEncodings)
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				minSize:        minSize,
+				status:         http.StatusOK,
+			}
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter buffers the start of a response until it knows whether the response is worth
+// compressing, then either compresses it or passes it through unchanged
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+	decided     bool
+	encoder     io.WriteCloser // Set once the response is being compressed
+}
+
+// WriteHeader implements http.ResponseWriter, delaying the header until the response has been
+// examined
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	// Responses without a body are never compressed
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+// Write implements http.ResponseWriter
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.minSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the header and any buffered content, compressing the response if it is large enough
+// and suitable
+func (cw *compressWriter) decide(largeEnough bool) error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	// Ranges are of the uncompressed content, so partial content is sent as it is
+	if largeEnough && cw.status != http.StatusPartialContent && header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		// The compressed bytes differ from the uncompressed ones that a strong tag identifies
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		switch cw.encoding {
+		case encodingBrotli:
+			writer := brotliWriterPool.Get().(*brotli.Writer)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		case encodingGzip:
+			writer := gzipWriterPool.Get().(*gzip.Writer)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// close finishes the response, sending a response too small to compress as it is and flushing the
+// encoder of a compressed one
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			// The handler wrote nothing, so leave the response to net/http
+			return
+		}
+		cw.decide(false)
+	}
+
+	if cw.encoder == nil {
+		return
+	}
+	cw.encoder.Close()
+
+	switch encoder := cw.encoder.(type) {
+	case *brotli.Writer:
+		encoder.Reset(nil)
+		brotliWriterPool.Put(encoder)
+	case *gzip.Writer:
+		encoder.Reset(nil)
+		gzipWriterPool.Put(encoder)
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// weakETag returns a weak entity tag for content. Rendered pages get weak tags because each
+// response carries its own script nonce, while being otherwise identical.
+func weakETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// writeNotModified sets the validators and Cache-Control header of a response, then reports
+// whether the request's If-None-Match or If-Modified-Since header shows the client already has the
+// current version, in which case a 304 Not Modified response has been written. A zero modified
+// time omits the Last-Modified header.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	header := w.Header()
+	header.Set("Cache-Control", revalidateCacheControl)
+	header.Set("ETag", etag)
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !isNotModified(r, etag, modified) {
+		return false
+	}
+
+	// The client keeps the headers it stored with its copy, including the Content-Security-Policy
+	// naming the nonce within it, so a new policy must not replace it
+	header.Del("Content-Security-Policy")
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// isNotModified evaluates the conditional headers of a GET or HEAD request
+func isNotModified(r *http.Request, etag string, modified time.Time) bool {
+	// If-None-Match takes precedence over If-Modified-Since when both are sent
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have a resolution of one second
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ContentConfigMapLabel marks the ConfigMaps that posts, pages and assets may read their content
+// from when set to "true". No other ConfigMaps are cached or readable through a configMapKeyRef.
+const ContentConfigMapLabel = "bloggernetes.davies.me.uk/content"
+
+// configMapIndex indexes posts, pages and assets by the namespace/name keys of the ConfigMaps their content
+// is read from, so that they can be reconciled again when one changes
+const configMapIndex = "configMap"
+
+// contentFromFields are the spec fields of each resource that reference content held outside it
+var contentFromFields = map[schema.GroupVersionResource]string{
+	BlogPostResource:  "bodyFrom",
+	BlogPageResource:  "contentFrom",
+	BlogAssetResource: "dataFrom",
+}
+
+// contentRef references content held in a key of a ConfigMap in the resource's namespace
+type contentRef struct {
+	configMap string
+	key       string
+}
+
+// contentReader reads the content a reference points to, from a resource in the given namespace
+type contentReader func(namespace string, ref *contentRef) (string, error)
+
+// contentRefFrom reads a content reference from a field of a resource's spec, returning nil if the
+// field is unset
+func contentRefFrom(spec map[string]interface{}, field string) (*contentRef, error) {
+	if _, found := spec[field]; !found {
+		return nil, nil
+	}
+
+	name, _, err := unstructured.NestedString(spec, field, "configMapKeyRef", "name")
+	if err != nil {
+		return nil, invalidSpec("invalid %s: %v", field, err)
+	}
+	key, _, err := unstructured.NestedString(spec, field, "configMapKeyRef", "key")
+	if err != nil {
+		return nil, invalidSpec("invalid %s: %v", field, err)
+	}
+	if name == "" || key == "" {
+		return nil, invalidSpec("%s must set configMapKeyRef with a name and key", field)
+	}
+
+	return &contentRef{configMap: name, key: key}, nil
+}
+
+// specContent returns the content of a resource, from an inline spec field or from where the
+// field's reference counterpart points
+func specContent(obj *unstructured.Unstructured, spec map[string]interface{}, field, fromField string, readContent contentReader) (string, error) {
+	ref, err := contentRefFrom(spec, fromField)
+	if err != nil {
+		return "", err
+	}
+	if ref == nil {
+		content, _ := spec[field].(string)
+		return content, nil
+	}
+
+	content, err := readContent(obj.GetNamespace(), ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", fromField, err)
+	}
+	return content, nil
+}
+
+// configMapIndexFunc indexes a post or page by the ConfigMap referenced by one of its spec fields
+func configMapIndexFunc(field string) cache.IndexFunc {
+	return func(obj interface{}) ([]string, error) {
+		unstructuredObj, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, nil
+		}
+
+		spec, _, _ := unstructured.NestedMap(unstructuredObj.Object, "spec")
+		ref, err := contentRefFrom(spec, field)
+		if err != nil || ref == nil {
+			return nil, nil
+		}
+		return []string{unstructuredObj.GetNamespace() + "/" + ref.configMap}, nil
+	}
+}
+
+// readContent reads referenced content from the controller's cache of ConfigMaps. A missing
+// ConfigMap or key is reported in the resource's status rather than retried, as the resource is
+// reconciled again once the ConfigMap changes.
+func (c *Controller) readContent(namespace string, ref *contentRef) (string, error) {
+	if c.configMaps == nil {
+		return "", invalidSpec("reading content from ConfigMaps is disabled")
+	}
+
+	obj, exists, err := c.configMaps.GetIndexer().GetByKey(namespace + "/" + ref.configMap)
+	if err != nil {
+		return "", fmt.Errorf("failed to get ConfigMap %s from cache: %w", ref.configMap, err)
+	}
+	if !exists {
+		return "", invalidSpec("ConfigMap %s not found, or not labelled %s=true", ref.configMap, ContentConfigMapLabel)
+	}
+
+	content, found, err := configMapValue(obj, ref.key)
+	if err != nil {
+		return "", invalidSpec("failed to read ConfigMap %s: %v", ref.configMap, err)
+	}
+	if !found {
+		return "", invalidSpec("ConfigMap %s has no key %s", ref.configMap, ref.key)
+	}
+	return content, nil
+}
+
+// configMapValue returns the value of a key under a ConfigMap's data or binaryData
+func configMapValue(obj interface{}, key string) (string, bool, error) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", false, fmt.Errorf("object is not an Unstructured")
+	}
+
+	if value, found, err := unstructured.NestedString(unstructuredObj.Object, "data", key); err != nil || found {
+		return value, found, err
+	}
+
+	encoded, found, err := unstructured.NestedString(unstructuredObj.Object, "binaryData", key)
+	if err != nil || !found {
+		return "", found, err
+	}
+	value, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to decode binaryData key %s: %w", key, err)
+	}
+	return string(value), true, nil
+}
+
+// configMapEventHandler returns the event handler for ConfigMaps, which queues the posts and pages
+// whose content a ConfigMap holds to be reconciled when it is added, changed or deleted
+func (c *Controller) configMapEventHandler() cache.ResourceEventHandler {
+	enqueueDependents := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			log.Error("Failed to get key of ConfigMap", "error", err)
+			return
+		}
+
+		for resource, informer := range c.informers {
+			dependents, err := informer.GetIndexer().ByIndex(configMapIndex, key)
+			if err != nil {
+				log.Error("Failed to find resources referencing ConfigMap", "resource", resource.Resource,
+					"configmap", key, "error", err)
+				continue
+			}
+			for _, dependent := range dependents {
+				c.enqueue(resource, dependent)
+			}
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueueDependents,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueueDependents(newObj)
+		},
+		DeleteFunc: enqueueDependents,
+	}
+}
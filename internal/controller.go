@@ -3,14 +3,18 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 // BlogPostResource defines the GVR for BlogPost CRD
@@ -27,25 +31,93 @@ var BlogPageResource = schema.GroupVersionResource{
 	Resource: "blogpages",
 }
 
-// Controller watches for BlogPost and BlogPage CRD changes and updates the store
+// BlogAssetResource defines the GVR for BlogAsset CRD
+var BlogAssetResource = schema.GroupVersionResource{
+	Group:    "alpha.bloggernetes.davies.me.uk",
+	Version:  "v1",
+	Resource: "blogassets",
+}
+
+// ControllerOptions configures the controller
+type ControllerOptions struct {
+	Namespace string // Namespace to watch for BlogPost, BlogPage and BlogAsset resources
+
+	// ContentConfigMaps allows content to be read from ConfigMaps labelled with
+	// ContentConfigMapLabel, which requires permission to list and watch ConfigMaps
+	ContentConfigMaps bool
+
+	// MaxWatchOutage is how long watches may keep failing before the controller reports itself
+	// not ready
+	MaxWatchOutage time.Duration
+
+	// LeaderElection elects one replica to write statuses, or nil for this replica to write them
+	LeaderElection *LeaderElectionOptions
+}
+
+// Controller watches for BlogPost, BlogPage and BlogAsset CRD changes and updates the store
 type Controller struct {
 	client    dynamic.Interface
 	store     *Store
+	renderer  *Renderer
 	namespace string
-	stopCh    chan struct{}
+
+	// stopCh is closed, once, when the controller is stopped
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// Events queue resources to be reconciled from the informers' caches
+	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+	queue     workqueue.RateLimitingInterface
+
+	// ConfigMaps that posts and pages may read their content from, or nil if content is not read
+	// from ConfigMaps
+	contentConfigMaps bool
+	configMaps        cache.SharedIndexInformer
+
+	// The ID in the store of each resource reconciled, so that it can be removed once deleted
+	idsMu sync.Mutex
+	ids   map[reconcileKey]string
+
+	// Readiness, which requires the informers to have synced and their watches to be working
+	synced         chan struct{} // Closed once every post and page has been loaded
+	initialSync    initialSync
+	watch          watchHealth
+	maxWatchOutage time.Duration
+
+	// Leadership, which is required to write to the cluster when leader election is enabled
+	leaderElection *LeaderElectionOptions
+	leader         atomic.Bool
 }
 
-// NewController creates a new controller for watching BlogPost CRDs
-func NewController(client dynamic.Interface, store *Store, namespace string) *Controller {
-	return &Controller{
-		client:    client,
-		store:     store,
-		namespace: namespace,
-		stopCh:    make(chan struct{}),
+// NewController creates a new controller for watching BlogPost, BlogPage and BlogAsset CRDs
+func NewController(client dynamic.Interface, store *Store, renderer *Renderer, options ControllerOptions) *Controller {
+	recordLeader(options.LeaderElection == nil)
+
+	c := &Controller{
+		client:         client,
+		store:          store,
+		renderer:       renderer,
+		namespace:      options.Namespace,
+		stopCh:         make(chan struct{}),
+		queue:          newReconcileQueue(),
+		ids:            make(map[reconcileKey]string),
+		synced:         make(chan struct{}),
+		maxWatchOutage: options.MaxWatchOutage,
+		leaderElection: options.LeaderElection,
+
+		contentConfigMaps: options.ContentConfigMaps,
 	}
+
+	// Reconcile a resource again when another takes its ID, or it takes the ID back once the other
+	// is deleted, to report it through the resource's status
+	store.WatchClaims(SourceCluster, func(owner ContentOwner) {
+		c.queue.Add(reconcileKey{resource: owner.Resource, key: owner.Key})
+	})
+	return c
 }
 
-// Start starts the controller
+// Start runs the controller until the context is cancelled or it is stopped, returning once its
+// informers and workers have stopped. Use WaitForSync to wait for it to load the posts and pages.
 func (c *Controller) Start(ctx context.Context) error {
 	log.Info("Starting controller", "namespace", c.namespace)
 
@@ -57,125 +129,202 @@ func (c *Controller) Start(ctx context.Context) error {
 		nil,
 	)
 
-	// Create an informer for BlogPost resources
-	postInformer := factory.ForResource(BlogPostResource).Informer()
+	// Create an informer for each resource, whose events queue the resource to be reconciled
+	c.informers = make(map[schema.GroupVersionResource]cache.SharedIndexInformer)
+	var registrations []cache.InformerSynced
+	for _, resource := range []schema.GroupVersionResource{BlogPostResource, BlogPageResource, BlogAssetResource} {
+		informer := factory.ForResource(resource).Informer()
 
-	// Add event handlers for BlogPost resources
-	postInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    c.handlePostAdd,
-		UpdateFunc: c.handlePostUpdate,
-		DeleteFunc: c.handlePostDelete,
-	})
+		indexers := cache.Indexers{configMapIndex: configMapIndexFunc(contentFromFields[resource])}
+		if err := informer.AddIndexers(indexers); err != nil {
+			return fmt.Errorf("failed to add %s indexers: %w", resource.Resource, err)
+		}
+		registration, err := informer.AddEventHandler(c.eventHandler(resource))
+		if err != nil {
+			return fmt.Errorf("failed to add %s event handler: %w", resource.Resource, err)
+		}
+		if err := informer.SetWatchErrorHandler(c.watch.errorHandler()); err != nil {
+			return fmt.Errorf("failed to set %s watch error handler: %w", resource.Resource, err)
+		}
 
-	// Create an informer for BlogPage resources
-	pageInformer := factory.ForResource(BlogPageResource).Informer()
+		c.informers[resource] = informer
+		registrations = append(registrations, registration.HasSynced)
+	}
 
-	// Add event handlers for BlogPage resources
-	pageInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    c.handlePageAdd,
-		UpdateFunc: c.handlePageUpdate,
-		DeleteFunc: c.handlePageDelete,
-	})
+	// Create an informer for the ConfigMaps labelled as holding content, whose events queue the
+	// resources reading content from them. The rest of the namespace's ConfigMaps are not cached.
+	var informers []cache.SharedIndexInformer
+	if c.contentConfigMaps {
+		configMapFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+			c.client,
+			time.Minute*30,
+			c.namespace,
+			func(options *metav1.ListOptions) {
+				options.LabelSelector = ContentConfigMapLabel + "=true"
+			},
+		)
+		c.configMaps = configMapFactory.ForResource(ConfigMapResource).Informer()
+		registration, err := c.configMaps.AddEventHandler(c.configMapEventHandler())
+		if err != nil {
+			return fmt.Errorf("failed to add configmaps event handler: %w", err)
+		}
+		if err := c.configMaps.SetWatchErrorHandler(c.watch.errorHandler()); err != nil {
+			return fmt.Errorf("failed to set configmaps watch error handler: %w", err)
+		}
+		registrations = append(registrations, registration.HasSynced)
+		informers = append(informers, c.configMaps)
+	}
 
-	// Start the informers
-	go postInformer.Run(c.stopCh)
-	go pageInformer.Run(c.stopCh)
+	// Stop the informers when the context is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.stopCh:
+		}
+	}()
 
-	// Wait for the informers to sync
-	if !cache.WaitForCacheSync(c.stopCh, postInformer.HasSynced, pageInformer.HasSynced) {
-		return fmt.Errorf("failed to sync informer caches")
+	// Start the informers
+	var running sync.WaitGroup
+	defer running.Wait()
+	for resource, informer := range c.informers {
+		recordSynced(resource, false)
+		informers = append(informers, informer)
+	}
+	for _, informer := range informers {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			informer.Run(c.stopCh)
+		}()
 	}
 
-	log.Info("Controller started successfully")
+	// Stop the workers along with the informers. Shutting the queue down discards anything still
+	// queued, which is rebuilt from the API server on the next start.
+	go func() {
+		<-c.stopCh
+		c.queue.ShutDown()
+	}()
+
+	// Wait for the informers to sync, when every resource has been queued. This only fails if the
+	// controller is stopped first.
+	if !cache.WaitForCacheSync(c.stopCh, registrations...) {
+		log.Info("Controller stopped before its informers synced")
+		return nil
+	}
 
-	// Wait for context cancellation
-	<-ctx.Done()
-	close(c.stopCh)
-	return nil
-}
+	// Reconcile the queued resources, and report the controller synced once every one listed has
+	// been added to the store
+	var keys []reconcileKey
+	for resource, informer := range c.informers {
+		for _, key := range informer.GetStore().ListKeys() {
+			keys = append(keys, reconcileKey{resource: resource, key: key})
+		}
+	}
+	initiallySynced := c.initialSync.begin(keys)
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		c.runWorkers()
+	}()
+
+	select {
+	case <-initiallySynced:
+	case <-c.stopCh:
+		log.Info("Controller stopped before reconciling every resource")
+		return nil
+	}
+	close(c.synced)
+	for resource := range c.informers {
+		recordSynced(resource, true)
+	}
 
-// Stop stops the controller
-func (c *Controller) Stop() {
-	close(c.stopCh)
-}
+	log.Info("Controller started successfully")
 
-// handlePostAdd handles the addition of a new BlogPost
-func (c *Controller) handlePostAdd(obj interface{}) {
-	post, err := convertToBlogPost(obj)
-	if err != nil {
-		log.Error("Failed to convert BlogPost", "error", err)
-		return
+	// Stand for leadership once the caches hold every resource whose status a leader must write
+	if c.leaderElection != nil {
+		electionCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-c.stopCh
+			cancel()
+		}()
+
+		if err := c.runLeaderElection(electionCtx, *c.leaderElection); err != nil {
+			c.Stop()
+			return err
+		}
 	}
 
-	log.Info("BlogPost added", "id", post.ID, "title", post.Title)
-	c.store.AddOrUpdatePost(post)
+	<-c.stopCh
+	log.Info("Stopping controller")
+	return nil
 }
 
-// handlePostUpdate handles the update of an existing BlogPost
-func (c *Controller) handlePostUpdate(oldObj, newObj interface{}) {
-	post, err := convertToBlogPost(newObj)
-	if err != nil {
-		log.Error("Failed to convert BlogPost", "error", err)
-		return
+// WaitForSync waits until the controller has loaded every post and page into the store, returning
+// an error if the context is cancelled or the controller stops first
+func (c *Controller) WaitForSync(ctx context.Context) error {
+	// Report a sync that has happened even if the controller has since stopped
+	select {
+	case <-c.synced:
+		return nil
+	default:
 	}
 
-	log.Info("BlogPost updated", "id", post.ID, "title", post.Title)
-	c.store.AddOrUpdatePost(post)
-}
-
-// handlePostDelete handles the deletion of a BlogPost
-func (c *Controller) handlePostDelete(obj interface{}) {
-	post, err := convertToBlogPost(obj)
-	if err != nil {
-		log.Error("Failed to convert BlogPost", "error", err)
-		return
+	select {
+	case <-c.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stopCh:
+		return fmt.Errorf("controller stopped before its informers synced")
 	}
+}
 
-	log.Info("BlogPost deleted", "id", post.ID, "title", post.Title)
-	c.store.DeletePost(post.ID)
+// Stop stops the controller; it may be called more than once, and before or after Start
+func (c *Controller) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
 }
 
-// handlePageAdd handles the addition of a new BlogPage
-func (c *Controller) handlePageAdd(obj interface{}) {
-	page, err := convertToBlogPage(obj)
-	if err != nil {
-		log.Error("Failed to convert BlogPage", "error", err)
-		return
+// recordRendered logs any problems found while converting or rendering a resource and reports
+// them through its Rendered status condition, if this replica is the leader
+func (c *Controller) recordRendered(resource schema.GroupVersionResource, obj interface{}, conversionErr error, renderErrors []string) error {
+	for _, renderErr := range renderErrors {
+		log.Warn("Problem rendering content", "resource", resource.Resource, "error", renderErr)
 	}
 
-	log.Info("BlogPage added", "id", page.ID, "title", page.Title)
-	c.store.AddOrUpdatePage(page)
-}
-
-// handlePageUpdate handles the update of an existing BlogPage
-func (c *Controller) handlePageUpdate(oldObj, newObj interface{}) {
-	page, err := convertToBlogPage(newObj)
-	if err != nil {
-		log.Error("Failed to convert BlogPage", "error", err)
-		return
+	if !c.IsLeader() {
+		return nil
 	}
 
-	log.Info("BlogPage updated", "id", page.ID, "title", page.Title)
-	c.store.AddOrUpdatePage(page)
+	condition := renderedCondition(conversionErr, renderErrors)
+	if err := c.updateCondition(resource, obj, condition); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+	return nil
 }
 
-// handlePageDelete handles the deletion of a BlogPage
-func (c *Controller) handlePageDelete(obj interface{}) {
-	page, err := convertToBlogPage(obj)
-	if err != nil {
-		log.Error("Failed to convert BlogPage", "error", err)
-		return
+// recordLoaded reports whether a BlogAsset was loaded through its Loaded status condition, if this
+// replica is the leader
+func (c *Controller) recordLoaded(obj interface{}, conversionErr error) error {
+	if !c.IsLeader() {
+		return nil
 	}
 
-	log.Info("BlogPage deleted", "id", page.ID, "title", page.Title)
-	c.store.DeletePage(page.ID)
+	if err := c.updateCondition(BlogAssetResource, obj, loadedCondition(conversionErr)); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+	return nil
 }
 
-// convertToBlogPost converts an unstructured object to a BlogPost
-func convertToBlogPost(obj interface{}) (*BlogPost, error) {
+// convertToBlogPost converts an unstructured object to a BlogPost, reading and rendering its body
+func convertToBlogPost(obj interface{}, renderer *Renderer, readContent contentReader) (*BlogPost, error) {
 	unstructuredObj, ok := obj.(*unstructured.Unstructured)
 	if !ok {
-		return nil, fmt.Errorf("object is not an Unstructured")
+		return nil, invalidSpec("object is not an Unstructured")
 	}
 
 	// No need to extract metadata for this conversion
@@ -183,15 +332,20 @@ func convertToBlogPost(obj interface{}) (*BlogPost, error) {
 	// Extract spec
 	spec, found, err := unstructured.NestedMap(unstructuredObj.Object, "spec")
 	if err != nil || !found {
-		return nil, fmt.Errorf("spec not found in BlogPost: %v", err)
+		return nil, invalidSpec("spec not found in BlogPost: %v", err)
 	}
 
 	// Extract fields from spec
 	id, _ := spec["id"].(string)
 	title, _ := spec["title"].(string)
-	body, _ := spec["body"].(string)
 	author, _ := spec["author"].(string)
 	metaDescription, _ := spec["metaDescription"].(string)
+	series, _ := spec["series"].(string)
+	seriesOrder, _ := spec["seriesOrder"].(int64) // Kubernetes stores numbers as int64
+	showTOC, found := spec["toc"].(bool)
+	if !found {
+		showTOC = true
+	}
 
 	// Extract tags
 	var tags []string
@@ -206,7 +360,7 @@ func convertToBlogPost(obj interface{}) (*BlogPost, error) {
 	// Parse dates
 	authoredDate, err := parseDate(spec["authoredDate"])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse authoredDate: %v", err)
+		return nil, invalidSpec("failed to parse authoredDate: %v", err)
 	}
 
 	var updatedDate *time.Time
@@ -217,6 +371,21 @@ func convertToBlogPost(obj interface{}) (*BlogPost, error) {
 		}
 	}
 
+	body, err := specContent(unstructuredObj, spec, "body", "bodyFrom", readContent)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := renderer.Render(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render body: %v", err)
+	}
+
+	var toc []*TOCEntry
+	if showTOC {
+		toc = rendered.TOC
+	}
+
 	return &BlogPost{
 		ID:              id,
 		Title:           title,
@@ -226,9 +395,33 @@ func convertToBlogPost(obj interface{}) (*BlogPost, error) {
 		Tags:            tags,
 		AuthoredDate:    authoredDate,
 		UpdatedDate:     updatedDate,
+		Series:          series,
+		SeriesOrder:     int(seriesOrder),
+		BodyHTML:        rendered.HTML,
+		TOC:             toc,
+		PlainText:       rendered.PlainText,
+		WordCount:       rendered.WordCount,
+		ReadingTime:     rendered.ReadingTime(),
+		HasMath:         rendered.HasMath,
+		HasMermaid:      rendered.HasMermaid,
+		RenderErrors:    rendered.Errors,
+		Modified:        resourceModified(unstructuredObj),
 	}, nil
 }
 
+// resourceModified returns when a resource last changed, the same on every replica: the newest time
+// its spec or metadata was written, ignoring writes to its status, or else when it was created.
+// Manifests read from files have neither, so it is zero for them.
+func resourceModified(obj *unstructured.Unstructured) time.Time {
+	modified := obj.GetCreationTimestamp().Time
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Subresource == "" && entry.Time != nil && entry.Time.After(modified) {
+			modified = entry.Time.Time
+		}
+	}
+	return modified
+}
+
 // parseDate parses a date string from the CRD
 func parseDate(dateInterface interface{}) (time.Time, error) {
 	dateStr, ok := dateInterface.(string)
@@ -240,29 +433,44 @@ func parseDate(dateInterface interface{}) (time.Time, error) {
 	return time.Parse(time.RFC3339, dateStr)
 }
 
-// convertToBlogPage converts an unstructured object to a BlogPage
-func convertToBlogPage(obj interface{}) (*BlogPage, error) {
+// convertToBlogPage converts an unstructured object to a BlogPage, reading and rendering its content
+func convertToBlogPage(obj interface{}, renderer *Renderer, readContent contentReader) (*BlogPage, error) {
 	unstructuredObj, ok := obj.(*unstructured.Unstructured)
 	if !ok {
-		return nil, fmt.Errorf("object is not an Unstructured")
+		return nil, invalidSpec("object is not an Unstructured")
 	}
 
 	// Extract spec
 	spec, found, err := unstructured.NestedMap(unstructuredObj.Object, "spec")
 	if err != nil || !found {
-		return nil, fmt.Errorf("spec not found in BlogPage: %v", err)
+		return nil, invalidSpec("spec not found in BlogPage: %v", err)
 	}
 
 	// Extract fields from spec
 	id, _ := spec["id"].(string)
 	title, _ := spec["title"].(string)
-	content, _ := spec["content"].(string)
 	order, _ := spec["order"].(int64) // Kubernetes stores numbers as int64
 
+	content, err := specContent(unstructuredObj, spec, "content", "contentFrom", readContent)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := renderer.Render(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render content: %v", err)
+	}
+
 	return &BlogPage{
-		ID:      id,
-		Title:   title,
-		Content: content,
-		Order:   int(order), // Convert int64 to int
+		ID:           id,
+		Title:        title,
+		Content:      content,
+		ContentHTML:  rendered.HTML,
+		PlainText:    rendered.PlainText,
+		Order:        int(order), // Convert int64 to int
+		HasMath:      rendered.HasMath,
+		HasMermaid:   rendered.HasMermaid,
+		RenderErrors: rendered.Errors,
+		Modified:     resourceModified(unstructuredObj),
 	}, nil
 }
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/goodsign/monday"
+)
+
+// DefaultLocale is the locale dates are written in when none is configured
+const DefaultLocale = "en_US"
+
+// Locales returns the names of the locales dates can be written in
+func Locales() []string {
+	locales := monday.ListLocales()
+	names := make([]string, len(locales))
+	for i, locale := range locales {
+		names[i] = string(locale)
+	}
+	return names
+}
+
+// parseLocale validates a locale name such as en_GB
+func parseLocale(name string) (monday.Locale, error) {
+	for _, locale := range monday.ListLocales() {
+		if string(locale) == name {
+			return locale, nil
+		}
+	}
+	return "", fmt.Errorf("unknown locale %q", name)
+}
+
+// excerptLength is the length in characters of the post extracts shown on listing pages
+const excerptLength = 200
+
+// templateFuncs returns the functions available to all templates, including those of themes:
+//
+//	date TIME                  The date in the blog's locale and timezone, such as "January 2, 2006"
+//	formatDate LAYOUT TIME     The date in a Go time layout, such as "2006-01-02", in the blog's locale and timezone
+//	truncate LENGTH TEXT       TEXT shortened to at most LENGTH characters, ending at a word with "…"
+//	slugify TEXT               TEXT in lowercase with runs of other characters replaced by "-"
+//	postURL ID                 The path of a post, and likewise pageURL, tagURL, authorURL and seriesURL
+//	markdown TEXT              TEXT rendered from Markdown to HTML, sanitized like post bodies
+//	excerpt LENGTH VALUE       The prose of a post, page or Markdown string, truncated to LENGTH characters
+//	dict KEY VALUE ...         A map of the given keys and values, for passing several values to a template
+//	list VALUE ...             A list of the given values
+//	asset NAME                 The content-hashed path of a static asset, such as "style.css"
+//	mermaidURL                 The URL of the mermaid script, or an empty string if diagrams are disabled
+//
+// TIME may be a time.Time or a *time.Time, and a nil *time.Time is written as an empty string.
+func (s *Server) templateFuncs(assets *assets) template.FuncMap {
+	return template.FuncMap{
+		"date": func(value interface{}) (string, error) {
+			return s.formatDate(monday.LongFormatsByLocale[s.locale], value)
+		},
+		"formatDate": s.formatDate,
+		"truncate":   truncate,
+		"slugify":    slugify,
+		"postURL":    func(id string) string { return "/post/" + url.PathEscape(id) },
+		"pageURL":    func(id string) string { return "/page/" + url.PathEscape(id) },
+		"tagURL":     func(tag string) string { return "/tag/" + url.PathEscape(tag) },
+		"authorURL":  func(author string) string { return "/author/" + url.PathEscape(author) },
+		"seriesURL":  func(name string) string { return "/series/" + url.PathEscape(name) },
+		"markdown":   s.markdown,
+		"excerpt":    s.excerpt,
+		"dict":       dict,
+		"list":       list,
+		"asset":      assets.path,
+		"mermaidURL": func() string { return s.mermaidScriptURL(assets) },
+	}
+}
+
+// mermaidScriptURL returns the configured URL of the mermaid script, or the path of the bundled
+// script if none is configured. It is empty when diagrams are disabled, so their sources are shown.
+func (s *Server) mermaidScriptURL(assets *assets) string {
+	if !s.mermaid {
+		return ""
+	}
+	if s.mermaidURL != "" {
+		return s.mermaidURL
+	}
+
+	path, err := assets.path(mermaidAsset)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// formatDate writes a time.Time or *time.Time using a Go time layout, in the blog's locale and timezone
+func (s *Server) formatDate(layout string, value interface{}) (string, error) {
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		if v == nil {
+			return "", nil
+		}
+		t = *v
+	default:
+		return "", fmt.Errorf("cannot format %T as a date", value)
+	}
+
+	return monday.Format(t.In(s.timezone), layout, s.locale), nil
+}
+
+// markdown renders Markdown to HTML for templates
+func (s *Server) markdown(source string) (template.HTML, error) {
+	rendered, err := s.renderer.Render(source)
+	if err != nil {
+		return "", err
+	}
+	return rendered.HTML, nil
+}
+
+// excerpt returns the start of the prose of a post, page or Markdown string
+func (s *Server) excerpt(length int, value interface{}) (string, error) {
+	var text string
+	switch v := value.(type) {
+	case *BlogPost:
+		text = v.PlainText
+	case *BlogPage:
+		text = v.PlainText
+	case string:
+		rendered, err := s.renderer.Render(v)
+		if err != nil {
+			return "", err
+		}
+		text = rendered.PlainText
+	default:
+		return "", fmt.Errorf("cannot take an excerpt of %T", value)
+	}
+
+	return truncate(length, text), nil
+}
+
+// truncate shortens text to at most length characters, preferring to end at a word boundary and
+// marking the cut with an ellipsis. A negative length is treated as 0.
+func truncate(length int, text string) string {
+	length = max(length, 0)
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	cut := runes[:length]
+	if space := strings.LastIndexFunc(string(cut), unicode.IsSpace); space > len(string(cut))/2 {
+		cut = []rune(string(cut)[:space])
+	}
+
+	return strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…"
+}
+
+// slugify converts text to lowercase letters and digits separated by single hyphens
+func slugify(text string) string {
+	var sb strings.Builder
+	pendingHyphen := false
+
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pendingHyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			pendingHyphen = false
+		} else {
+			pendingHyphen = true
+		}
+	}
+
+	return sb.String()
+}
+
+// dict builds a map from alternating keys and values
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict requires an even number of arguments, got %d", len(pairs))
+	}
+
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict keys must be strings, got %T", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+
+	return m, nil
+}
+
+// list builds a list from its arguments
+func list(items ...interface{}) []interface{} {
+	return items
+}
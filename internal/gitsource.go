@@ -0,0 +1,670 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// DefaultGitPollInterval is how often the git repository is pulled when no interval is configured
+const DefaultGitPollInterval = time.Minute
+
+// gitRetryInterval is how long to wait before retrying a failed pull, if the next poll is later
+const gitRetryInterval = 10 * time.Second
+
+// gitWebhookPath is the URL path git hosts notify of pushes on, so that the repository is pulled
+// without waiting for the next poll
+const gitWebhookPath = "/webhooks/git"
+
+// gitWebhookMaxBody is the largest webhook payload read to verify its signature
+const gitWebhookMaxBody = 5 << 20
+
+// errGitNotSynced is reported until the git repository has been loaded into the store
+var errGitNotSynced = errors.New("git repository has not been synced")
+
+// gitKinds are the resources that manifests in the git repository may define, by kind
+var gitKinds = map[string]schema.GroupVersionResource{
+	"BlogPost":  BlogPostResource,
+	"BlogPage":  BlogPageResource,
+	"BlogAsset": BlogAssetResource,
+}
+
+// frontMatterBodyFields are the spec fields the Markdown after a file's front matter is read into,
+// by kind
+var frontMatterBodyFields = map[string]string{
+	"BlogPost": "body",
+	"BlogPage": "content",
+}
+
+func init() {
+	// Serve local repositories in-process, as go-git otherwise runs git-upload-pack to read them,
+	// which the container image does not include
+	client.InstallProtocol("file", server.NewServer(localRepositoryLoader{}))
+}
+
+// localRepositoryLoader opens repositories on the local filesystem for the in-process file
+// transport, whether or not they are bare
+type localRepositoryLoader struct{}
+
+// Load implements server.Loader
+func (localRepositoryLoader) Load(endpoint *transport.Endpoint) (storer.Storer, error) {
+	repo, err := git.PlainOpen(endpoint.Path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo.Storer, nil
+}
+
+// GitSourceOptions configures the git content source
+type GitSourceOptions struct {
+	URL    string // URL of the repository, or the path of a local repository
+	Branch string // Branch to read, or empty for the repository's default branch
+	Dir    string // Directory of the repository holding the content, or empty for its root
+
+	// PollInterval is how often the repository is pulled, or 0 to only pull when notified through
+	// the webhook. Each push only notifies one replica, so the others need to poll.
+	PollInterval time.Duration
+
+	// WebhookSecret verifies webhook requests, or is empty to disable the webhook
+	WebhookSecret string
+}
+
+// GitSource loads posts, pages and assets from a git repository into the store alongside those in
+// the cluster, pulling it periodically or when notified of a push. Files are either manifests of
+// BlogPost, BlogPage and BlogAsset resources, or Markdown files whose YAML front matter holds the
+// spec of a post or page.
+type GitSource struct {
+	store    *Store
+	renderer *Renderer
+	options  GitSourceOptions
+
+	// Whether the repository is cloned without its history, which the in-process file transport
+	// does not support
+	shallow bool
+
+	// The content loaded from the repository. Only Run uses these.
+	commit plumbing.Hash
+	files  map[string]gitFile // Files loaded, by path within Dir
+
+	trigger    chan struct{} // Receives webhook notifications, coalescing those not yet handled
+	synced     chan struct{} // Closed once the repository has first been loaded
+	syncedOnce sync.Once
+}
+
+// gitObject is a post, page or asset in the store loaded from the git repository
+type gitObject struct {
+	resource schema.GroupVersionResource
+	id       string
+}
+
+// gitFile is a file loaded from the git repository, along with what it added to the store
+type gitFile struct {
+	hash    plumbing.Hash
+	objects []gitObject
+}
+
+// NewGitSource creates a content source for a git repository, loading its content into the store
+func NewGitSource(store *Store, renderer *Renderer, options GitSourceOptions) (*GitSource, error) {
+	if options.URL == "" {
+		return nil, fmt.Errorf("git repository URL is required")
+	}
+	if options.PollInterval < 0 {
+		return nil, fmt.Errorf("git poll interval must not be negative")
+	}
+	if options.PollInterval == 0 && options.WebhookSecret == "" {
+		return nil, fmt.Errorf("git poll interval must not be 0 without a webhook secret to prompt pulls")
+	}
+	options.Dir = strings.Trim(path.Clean("/"+options.Dir), "/")
+
+	endpoint, err := transport.NewEndpoint(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git repository URL: %w", err)
+	}
+
+	return &GitSource{
+		store:    store,
+		renderer: renderer,
+		options:  options,
+		shallow:  endpoint.Protocol != "file",
+		files:    make(map[string]gitFile),
+		trigger:  make(chan struct{}, 1),
+		synced:   make(chan struct{}),
+	}, nil
+}
+
+// Run pulls the repository and loads its content into the store, then again whenever it is polled
+// or notified of a push, until the context is cancelled. Failures are logged and retried, keeping
+// the content last loaded.
+func (g *GitSource) Run(ctx context.Context) error {
+	log.Info("Watching git repository", "url", g.options.URL, "branch", g.options.Branch, "dir", g.options.Dir)
+
+	for {
+		err := g.sync(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		recordGitSync(err)
+
+		wait := g.options.PollInterval
+		if err != nil {
+			log.Error("Failed to sync git repository, keeping the content last loaded", "url", g.options.URL, "error", err)
+			if wait == 0 || wait > gitRetryInterval {
+				wait = gitRetryInterval
+			}
+		}
+
+		// Without polling, only the webhook prompts another pull
+		var poll <-chan time.Time
+		if wait > 0 {
+			poll = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-poll:
+		case <-g.trigger:
+		}
+	}
+}
+
+// WaitForSync waits until the repository has first been loaded into the store, returning an
+// error if the context is cancelled first
+func (g *GitSource) WaitForSync(ctx context.Context) error {
+	select {
+	case <-g.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ready reports why the repository's content is not yet in the store, or nil once it is
+func (g *GitSource) Ready() error {
+	select {
+	case <-g.synced:
+		return nil
+	default:
+		return errGitNotSynced
+	}
+}
+
+// sync checks the head of the branch and, if it has moved, clones the repository to load the files
+// that changed into the store and remove what was loaded from files since deleted
+func (g *GitSource) sync(ctx context.Context) error {
+	head, err := g.head(ctx)
+	if err != nil {
+		return err
+	}
+	if head == g.commit {
+		return nil
+	}
+
+	commit, err := g.clone(ctx)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("failed to read tree of commit %s: %w", commit.Hash, err)
+	}
+	if g.options.Dir != "" {
+		if tree, err = tree.Tree(g.options.Dir); err != nil {
+			return fmt.Errorf("failed to read directory %s of commit %s: %w", g.options.Dir, commit.Hash, err)
+		}
+	}
+
+	files := make(map[string]gitFile)
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if isGitContentFile(file.Name) {
+			files[file.Name] = g.load(file, commit.Committer.When)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read files of commit %s: %w", commit.Hash, err)
+	}
+
+	g.removeStale(files)
+	g.files = files
+	g.commit = commit.Hash
+	log.Info("Git repository synced", "commit", commit.Hash.String(), "files", len(files))
+
+	g.syncedOnce.Do(func() { close(g.synced) })
+	return nil
+}
+
+// head lists the repository's references to find the commit at the head of the branch, without
+// fetching any objects
+func (g *GitSource) head(ctx context.Context) (plumbing.Hash, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{g.options.URL},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to list references of %s: %w", g.options.URL, err)
+	}
+
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+
+	// The remote's HEAD is read if no branch is named, which may be a symbolic reference to it
+	name := plumbing.HEAD
+	if g.options.Branch != "" {
+		name = plumbing.NewBranchReferenceName(g.options.Branch)
+	}
+	ref := byName[name]
+	if ref != nil && ref.Type() == plumbing.SymbolicReference {
+		ref = byName[ref.Target()]
+	}
+	if ref == nil {
+		return plumbing.ZeroHash, fmt.Errorf("%s not found in %s", name.Short(), g.options.URL)
+	}
+	return ref.Hash(), nil
+}
+
+// clone clones the branch into memory and returns the commit at its head. Each sync clones afresh,
+// so that only the files in use are held rather than every version fetched since starting, and
+// remote repositories are cloned without their history.
+func (g *GitSource) clone(ctx context.Context) (*object.Commit, error) {
+	cloneOptions := &git.CloneOptions{
+		URL:          g.options.URL,
+		SingleBranch: true,
+		Tags:         git.NoTags,
+	}
+	if g.options.Branch != "" {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(g.options.Branch)
+	}
+	if g.shallow {
+		cloneOptions.Depth = 1
+	}
+
+	// Only the objects are kept; files are read from them rather than checked out
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), nil, cloneOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %w", g.options.URL, err)
+	}
+
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve head of %s: %w", g.options.URL, err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", ref.Hash(), err)
+	}
+	return commit, nil
+}
+
+// isGitContentFile reports whether a file in the repository may hold content. Hidden files and
+// directories are skipped.
+func isGitContentFile(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+
+	switch path.Ext(name) {
+	case ".md", ".markdown", ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// load loads a file's posts, pages and assets into the store, unless it is unchanged since it was
+// last loaded, marking them as modified when the commit was made. If any fail to load, nothing previously loaded from the file is removed, as with a
+// resource that fails to convert.
+func (g *GitSource) load(file *object.File, modified time.Time) gitFile {
+	previous, existed := g.files[file.Name]
+	if existed && previous.hash == file.Hash {
+		return previous
+	}
+
+	loaded := gitFile{hash: file.Hash}
+	content, err := file.Contents()
+	if err == nil {
+		var objects []*unstructured.Unstructured
+		objects, err = parseGitFile(file.Name, content)
+		for _, obj := range objects {
+			loadedObject, objErr := g.add(file.Name, obj, modified)
+			if objErr != nil {
+				err = errors.Join(err, objErr)
+				continue
+			}
+			loaded.objects = append(loaded.objects, loadedObject)
+		}
+	}
+	if err != nil {
+		log.Error("Failed to load file from git repository", "path", file.Name, "error", err)
+		loaded.objects = append(loaded.objects, previous.objects...)
+	}
+	return loaded
+}
+
+// add converts a resource read from the repository and adds it to the store. One whose ID is
+// already used by a resource in the cluster, or an earlier file, is kept in case that is deleted.
+func (g *GitSource) add(name string, obj *unstructured.Unstructured, modified time.Time) (gitObject, error) {
+	resource := gitKinds[obj.GetKind()]
+
+	switch resource {
+	case BlogPostResource:
+		post, err := convertToBlogPost(obj, g.renderer, readGitContent)
+		if err != nil {
+			recordConversionFailure(resource)
+			return gitObject{}, fmt.Errorf("failed to convert BlogPost: %w", err)
+		}
+		logRenderErrors(name, post.RenderErrors)
+		post.Modified = modified
+
+		_, existed := g.store.GetPost(post.ID)
+		changed, err := g.store.AddOrUpdatePost(g.owner(resource, name), post)
+		if err != nil {
+			log.Warn("BlogPost not served", "path", name, "error", err)
+		} else if changed && existed {
+			log.Info("BlogPost updated", "id", post.ID, "title", post.Title, "path", name)
+		} else if changed {
+			log.Info("BlogPost added", "id", post.ID, "title", post.Title, "path", name)
+		}
+		return gitObject{resource: resource, id: post.ID}, nil
+
+	case BlogPageResource:
+		page, err := convertToBlogPage(obj, g.renderer, readGitContent)
+		if err != nil {
+			recordConversionFailure(resource)
+			return gitObject{}, fmt.Errorf("failed to convert BlogPage: %w", err)
+		}
+		logRenderErrors(name, page.RenderErrors)
+		page.Modified = modified
+
+		_, existed := g.store.GetPage(page.ID)
+		changed, err := g.store.AddOrUpdatePage(g.owner(resource, name), page)
+		if err != nil {
+			log.Warn("BlogPage not served", "path", name, "error", err)
+		} else if changed && existed {
+			log.Info("BlogPage updated", "id", page.ID, "title", page.Title, "path", name)
+		} else if changed {
+			log.Info("BlogPage added", "id", page.ID, "title", page.Title, "path", name)
+		}
+		return gitObject{resource: resource, id: page.ID}, nil
+
+	case BlogAssetResource:
+		asset, err := convertToBlogAsset(obj, readGitContent)
+		if err != nil {
+			recordConversionFailure(resource)
+			return gitObject{}, fmt.Errorf("failed to convert BlogAsset: %w", err)
+		}
+		asset.Modified = modified
+
+		_, existed := g.store.GetAsset(asset.Name)
+		changed, err := g.store.AddOrUpdateAsset(g.owner(resource, name), asset)
+		if err != nil {
+			log.Warn("BlogAsset not served", "path", name, "error", err)
+		} else if changed && existed {
+			log.Info("BlogAsset updated", "name", asset.Name, "bytes", len(asset.Content), "path", name)
+		} else if changed {
+			log.Info("BlogAsset added", "name", asset.Name, "bytes", len(asset.Content), "path", name)
+		}
+		return gitObject{resource: resource, id: asset.Name}, nil
+
+	default:
+		return gitObject{}, fmt.Errorf("unknown kind %s", obj.GetKind())
+	}
+}
+
+// removeStale removes what was loaded from the repository but is no longer in any of its files,
+// because a file was deleted or no longer defines it
+func (g *GitSource) removeStale(files map[string]gitFile) {
+	for name, file := range g.files {
+		current := make(map[gitObject]bool)
+		for _, obj := range files[name].objects {
+			current[obj] = true
+		}
+
+		for _, obj := range file.objects {
+			if current[obj] {
+				continue
+			}
+			// Only remove each once, in case the file defined it several times
+			current[obj] = true
+
+			owner := g.owner(obj.resource, name)
+			switch obj.resource {
+			case BlogPostResource:
+				log.Info("BlogPost deleted", "id", obj.id, "path", name)
+				g.store.DeletePost(owner, obj.id)
+			case BlogPageResource:
+				log.Info("BlogPage deleted", "id", obj.id, "path", name)
+				g.store.DeletePage(owner, obj.id)
+			case BlogAssetResource:
+				log.Info("BlogAsset deleted", "name", obj.id, "path", name)
+				g.store.DeleteAsset(owner, obj.id)
+			}
+		}
+	}
+}
+
+// owner returns the owner in the store of what a file defines
+func (g *GitSource) owner(resource schema.GroupVersionResource, name string) ContentOwner {
+	return ContentOwner{Source: SourceGit, Resource: resource, Key: name}
+}
+
+// logRenderErrors logs the problems found while rendering content from a file
+func logRenderErrors(name string, renderErrors []string) {
+	for _, renderErr := range renderErrors {
+		log.Warn("Problem rendering content", "path", name, "error", renderErr)
+	}
+}
+
+// readGitContent rejects references to ConfigMaps from the repository's manifests, as content in
+// the repository belongs in its own files
+func readGitContent(namespace string, ref *contentRef) (string, error) {
+	return "", invalidSpec("ConfigMap %s cannot be read from a git repository", ref.configMap)
+}
+
+// parseGitFile parses the resources defined by a file in the repository: the BlogPost, BlogPage
+// and BlogAsset manifests of a YAML or JSON file, or the post or page of a Markdown file with front
+// matter. Other manifests, and Markdown files without front matter such as READMEs, are skipped.
+func parseGitFile(name, content string) ([]*unstructured.Unstructured, error) {
+	switch path.Ext(name) {
+	case ".md", ".markdown":
+		obj, err := parseFrontMatterFile(name, content)
+		if err != nil || obj == nil {
+			return nil, err
+		}
+		return []*unstructured.Unstructured{obj}, nil
+	default:
+		return parseManifests(content)
+	}
+}
+
+// parseManifests parses the BlogPost, BlogPage and BlogAsset manifests among the YAML documents,
+// or JSON object, of a file
+func parseManifests(content string) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(strings.NewReader(content)))
+	for document := 1; ; document++ {
+		data, err := reader.Read()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read document %d: %w", document, err)
+		}
+
+		data, err = utilyaml.ToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse document %d: %w", document, err)
+		}
+		if strings.TrimSpace(string(data)) == "null" {
+			continue
+		}
+
+		// Unstructured objects keep whole numbers as int64, as the converters expect
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(data); err != nil {
+			if runtime.IsMissingKind(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to parse document %d: %w", document, err)
+		}
+		if _, isContent := gitKinds[obj.GetKind()]; !isContent || obj.GroupVersionKind().Group != BlogPostResource.Group {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// parseFrontMatterFile parses a Markdown file whose YAML front matter holds the spec of a post, or
+// of a page if its kind is BlogPage, returning nil if it has no front matter. The post or page's
+// ID defaults to the file's name without its extension.
+func parseFrontMatterFile(name, content string) (*unstructured.Unstructured, error) {
+	frontMatter, body, found := splitFrontMatter(content)
+	if !found {
+		return nil, nil
+	}
+
+	data, err := utilyaml.ToJSON([]byte(frontMatter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse front matter: %w", err)
+	}
+	var spec map[string]interface{}
+	if err := utiljson.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse front matter: %w", err)
+	}
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+
+	kind := "BlogPost"
+	if specKind, found := spec["kind"]; found {
+		kind, _ = specKind.(string)
+		delete(spec, "kind")
+	}
+	field, found := frontMatterBodyFields[kind]
+	if !found {
+		return nil, fmt.Errorf("front matter kind must be BlogPost or BlogPage, not %q", kind)
+	}
+
+	if _, found := spec["id"]; !found {
+		spec["id"] = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	spec[field] = body
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": BlogPostResource.GroupVersion().String(),
+		"kind":       kind,
+		"spec":       spec,
+	}}, nil
+}
+
+// splitFrontMatter splits Markdown into the YAML front matter between its leading --- lines and the
+// body after them
+func splitFrontMatter(content string) (frontMatter, body string, found bool) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	rest, found := strings.CutPrefix(content, "---\n")
+	if !found {
+		return "", content, false
+	}
+
+	// The closing line may end the file
+	rest = "\n" + rest
+	end := strings.Index(rest, "\n---\n")
+	if end < 0 {
+		if !strings.HasSuffix(rest, "\n---") {
+			return "", content, false
+		}
+		return rest[:len(rest)-len("\n---")], "", true
+	}
+	return rest[:end], rest[end+len("\n---\n"):], true
+}
+
+// Webhook returns the handler git hosts notify of pushes through, or nil if the webhook is disabled
+func (g *GitSource) Webhook() http.Handler {
+	if g.options.WebhookSecret == "" {
+		return nil
+	}
+	return http.HandlerFunc(g.handleWebhook)
+}
+
+// handleWebhook prompts the repository to be pulled when its host notifies of a push. Any verified
+// event prompts a pull, which finds nothing new if the branch has not moved.
+func (g *GitSource) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, gitWebhookMaxBody))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !g.verifyWebhook(r.Header, body) {
+		log.Warn("Rejected git webhook that failed verification", "request_id", requestIDFrom(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A pull already waiting covers this push too
+	select {
+	case g.trigger <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyWebhook reports whether a webhook request came from the repository's host: GitHub and
+// Gitea sign the payload with the secret in X-Hub-Signature-256, and GitLab sends the secret itself
+// in X-Gitlab-Token
+func (g *GitSource) verifyWebhook(header http.Header, body []byte) bool {
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		return hmac.Equal([]byte(token), []byte(g.options.WebhookSecret))
+	}
+
+	signature, found := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+	if !found {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.options.WebhookSecret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
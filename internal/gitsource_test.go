@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name            string
+		content         string
+		wantFrontMatter string
+		wantBody        string
+		wantFound       bool
+	}{
+		{
+			name:            "front matter and body",
+			content:         "---\ntitle: Hello\n---\n# Hello\n",
+			wantFrontMatter: "\ntitle: Hello",
+			wantBody:        "# Hello\n",
+			wantFound:       true,
+		},
+		{
+			name:            "windows line endings",
+			content:         "---\r\ntitle: Hello\r\n---\r\nBody\r\n",
+			wantFrontMatter: "\ntitle: Hello",
+			wantBody:        "Body\n",
+			wantFound:       true,
+		},
+		{
+			name:            "closing line ends the file",
+			content:         "---\ntitle: Hello\n---",
+			wantFrontMatter: "\ntitle: Hello",
+			wantFound:       true,
+		},
+		{
+			name:            "empty front matter",
+			content:         "---\n---\nBody",
+			wantFrontMatter: "",
+			wantBody:        "Body",
+			wantFound:       true,
+		},
+		{
+			name:     "no front matter",
+			content:  "# README\n\n---\n",
+			wantBody: "# README\n\n---\n",
+		},
+		{
+			name:     "unclosed front matter",
+			content:  "---\ntitle: Hello\n",
+			wantBody: "---\ntitle: Hello\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frontMatter, body, found := splitFrontMatter(test.content)
+			if frontMatter != test.wantFrontMatter || body != test.wantBody || found != test.wantFound {
+				t.Errorf("expected (%q, %q, %v), got (%q, %q, %v)",
+					test.wantFrontMatter, test.wantBody, test.wantFound, frontMatter, body, found)
+			}
+		})
+	}
+}
+
+func TestParseFrontMatterFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		wantKind  string
+		wantID    string
+		wantField string
+		wantErr   bool
+	}{
+		{
+			name:      "post by default",
+			file:      "posts/hello-world.md",
+			content:   "---\ntitle: Hello\n---\nBody",
+			wantKind:  "BlogPost",
+			wantID:    "hello-world",
+			wantField: "body",
+		},
+		{
+			name:      "page",
+			file:      "about.markdown",
+			content:   "---\nkind: BlogPage\ntitle: About\n---\nBody",
+			wantKind:  "BlogPage",
+			wantID:    "about",
+			wantField: "content",
+		},
+		{
+			name:      "explicit ID",
+			file:      "posts/2024-01-01-hello.md",
+			content:   "---\nid: hello\n---\nBody",
+			wantKind:  "BlogPost",
+			wantID:    "hello",
+			wantField: "body",
+		},
+		{
+			name:    "other kind",
+			file:    "logo.md",
+			content: "---\nkind: BlogAsset\n---\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid YAML",
+			file:    "broken.md",
+			content: "---\ntitle: [unclosed\n---\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj, err := parseFrontMatterFile(test.file, test.content)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+
+			if obj.GetKind() != test.wantKind {
+				t.Errorf("expected kind %s, got %s", test.wantKind, obj.GetKind())
+			}
+			spec := obj.Object["spec"].(map[string]interface{})
+			if spec["id"] != test.wantID {
+				t.Errorf("expected ID %q, got %v", test.wantID, spec["id"])
+			}
+			if spec[test.wantField] != "Body" {
+				t.Errorf("expected the body in %s, got %v", test.wantField, spec[test.wantField])
+			}
+			if _, found := spec["kind"]; found {
+				t.Errorf("expected kind to be removed from the spec")
+			}
+		})
+	}
+
+	obj, err := parseFrontMatterFile("README.md", "# README")
+	if obj != nil || err != nil {
+		t.Errorf("expected a file without front matter to be skipped, got %v, %v", obj, err)
+	}
+}
+
+func TestParseManifests(t *testing.T) {
+	content := `apiVersion: alpha.bloggernetes.davies.me.uk/v1
+kind: BlogPost
+spec:
+  id: first
+---
+# An empty document
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: skipped
+---
+apiVersion: example.com/v1
+kind: BlogPost
+spec:
+  id: other-group
+---
+apiVersion: alpha.bloggernetes.davies.me.uk/v1
+kind: BlogAsset
+spec:
+  name: logo.png
+  data: aGVsbG8=
+`
+
+	objects, err := parseManifests(content)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	var kinds []string
+	for _, obj := range objects {
+		kinds = append(kinds, obj.GetKind())
+	}
+	if strings.Join(kinds, ",") != "BlogPost,BlogAsset" {
+		t.Errorf("expected a BlogPost and a BlogAsset, got %v", kinds)
+	}
+
+	if _, err := parseManifests("kind: BlogPost\nspec: [unclosed\n"); err == nil {
+		t.Errorf("expected an error for invalid YAML")
+	}
+}
+
+func TestGitSourceSync(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("failed to get worktree: %v", err)
+	}
+
+	// commit writes, or with empty content deletes, the files and commits them
+	commit := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if content == "" {
+				if _, err := worktree.Remove(name); err != nil {
+					t.Fatalf("failed to remove %s: %v", name, err)
+				}
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatalf("failed to create directory for %s: %v", name, err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+			if _, err := worktree.Add(name); err != nil {
+				t.Fatalf("failed to add %s: %v", name, err)
+			}
+		}
+		_, err := worktree.Commit("Update content", &git.CommitOptions{
+			Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+
+	store := NewStore()
+	renderer, err := NewRenderer(DefaultShortcodes(), DefaultHTMLPolicy, ImageOptions{})
+	if err != nil {
+		t.Fatalf("failed to create renderer: %v", err)
+	}
+	source, err := NewGitSource(store, renderer, GitSourceOptions{URL: dir, Dir: "content", PollInterval: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to create git source: %v", err)
+	}
+	sync := func() {
+		t.Helper()
+		if err := source.sync(context.Background()); err != nil {
+			t.Fatalf("failed to sync: %v", err)
+		}
+	}
+
+	commit(map[string]string{
+		"content/posts/hello.md": "---\ntitle: Hello\nauthoredDate: \"2024-01-01T00:00:00Z\"\n---\nFirst version",
+		"content/site.yaml": `apiVersion: alpha.bloggernetes.davies.me.uk/v1
+kind: BlogPage
+spec:
+  id: about
+  title: About
+---
+apiVersion: alpha.bloggernetes.davies.me.uk/v1
+kind: BlogAsset
+spec:
+  name: hello.txt
+  data: aGVsbG8=
+`,
+		"content/README.md":      "# Content",
+		"outside/ignored.md":     "---\ntitle: Ignored\n---\n",
+		"content/.drafts/new.md": "---\ntitle: Draft\n---\n",
+	})
+	sync()
+
+	if post, exists := store.GetPost("hello"); !exists || post.Title != "Hello" {
+		t.Fatalf("expected the post to be loaded, got %v", post)
+	}
+	if _, exists := store.GetPage("about"); !exists {
+		t.Errorf("expected the page to be loaded")
+	}
+	if _, exists := store.GetAsset("hello.txt"); !exists {
+		t.Errorf("expected the asset to be loaded")
+	}
+	for _, id := range []string{"README", "ignored", "new"} {
+		if _, exists := store.GetPost(id); exists {
+			t.Errorf("expected %s to be skipped", id)
+		}
+	}
+	if err := source.Ready(); err != nil {
+		t.Errorf("expected the source to be ready, got %v", err)
+	}
+
+	// A new commit updates the post
+	commit(map[string]string{"content/posts/hello.md": "---\ntitle: Hello again\nauthoredDate: \"2024-01-01T00:00:00Z\"\n---\nSecond version"})
+	sync()
+	if post, _ := store.GetPost("hello"); post.Title != "Hello again" {
+		t.Errorf("expected the post to be updated, got %q", post.Title)
+	}
+
+	// A second file with the same ID waits until the first is deleted, as when a file is renamed
+	commit(map[string]string{"content/posts/renamed.md": "---\nid: hello\ntitle: Renamed\nauthoredDate: \"2024-01-01T00:00:00Z\"\n---\nBody"})
+	sync()
+	if post, _ := store.GetPost("hello"); post.Title != "Hello again" {
+		t.Errorf("expected the first file's post to be served, got %q", post.Title)
+	}
+	commit(map[string]string{"content/posts/hello.md": ""})
+	sync()
+	if post, exists := store.GetPost("hello"); !exists || post.Title != "Renamed" {
+		t.Errorf("expected the second file's post to be served once the first was deleted")
+	}
+
+	// Deleting files removes what they defined
+	commit(map[string]string{"content/posts/renamed.md": "", "content/site.yaml": ""})
+	sync()
+	if _, exists := store.GetPost("hello"); exists {
+		t.Errorf("expected the post to be removed")
+	}
+	if _, gone := store.GetDeletedPost("hello"); !gone {
+		t.Errorf("expected the post to be reported as deleted")
+	}
+	if _, exists := store.GetPage("about"); exists {
+		t.Errorf("expected the page to be removed")
+	}
+	if _, exists := store.GetAsset("hello.txt"); exists {
+		t.Errorf("expected the asset to be removed")
+	}
+}
+
+func TestGitWebhookVerification(t *testing.T) {
+	const secret = "s3cret"
+	body := `{"ref":"refs/heads/main"}`
+
+	sign := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "GitHub signature", header: "X-Hub-Signature-256", value: sign(secret), wantStatus: http.StatusAccepted},
+		{name: "GitHub signature with the wrong secret", header: "X-Hub-Signature-256", value: sign("wrong"), wantStatus: http.StatusUnauthorized},
+		{name: "GitHub signature that is not hex", header: "X-Hub-Signature-256", value: "sha256=zz", wantStatus: http.StatusUnauthorized},
+		{name: "GitLab token", header: "X-Gitlab-Token", value: secret, wantStatus: http.StatusAccepted},
+		{name: "GitLab token that is wrong", header: "X-Gitlab-Token", value: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "unsigned", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, err := NewGitSource(NewStore(), nil, GitSourceOptions{URL: t.TempDir(), WebhookSecret: secret})
+			if err != nil {
+				t.Fatalf("failed to create git source: %v", err)
+			}
+
+			request := httptest.NewRequest(http.MethodPost, gitWebhookPath, strings.NewReader(body))
+			if test.header != "" {
+				request.Header.Set(test.header, test.value)
+			}
+			response := httptest.NewRecorder()
+			source.Webhook().ServeHTTP(response, request)
+
+			if response.Code != test.wantStatus {
+				t.Errorf("expected status %d, got %d", test.wantStatus, response.Code)
+			}
+			triggered := len(source.trigger) > 0
+			if triggered != (test.wantStatus == http.StatusAccepted) {
+				t.Errorf("expected a pull to be triggered only when verified, triggered: %v", triggered)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultMaxWatchOutage is how long the controller's watches may keep failing before the blog
+// reports itself not ready, as its content may be out of date
+const DefaultMaxWatchOutage = 5 * time.Minute
+
+// watchErrorWindow is how long after a watch error the watch is still considered broken. Informers
+// retry failed lists and watches with a backoff of up to 30 seconds plus as much again in jitter,
+// and each attempt may take a while to fail against an unreachable API server, so errors closer
+// together than this belong to the same outage.
+const watchErrorWindow = 3 * time.Minute
+
+// Paths of the liveness and readiness probes
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// errNotSynced is reported until the controller has loaded every post and page into the store
+var errNotSynced = errors.New("informer caches have not synced")
+
+// watchHealth tracks failures of the controller's watches on the API server
+type watchHealth struct {
+	mu          sync.Mutex
+	outageStart time.Time // When the current run of errors began
+	lastError   time.Time
+}
+
+// errorHandler returns a watch error handler for an informer, which logs the error as informers
+// do by default and records when it happened
+func (h *watchHealth) errorHandler() cache.WatchErrorHandler {
+	return func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		now := time.Now()
+		if now.Sub(h.lastError) > watchErrorWindow {
+			h.outageStart = now
+		}
+		h.lastError = now
+	}
+}
+
+// outage returns how long the watches have been failing, or zero if they are healthy
+func (h *watchHealth) outage() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastError.IsZero() || time.Since(h.lastError) > watchErrorWindow {
+		return 0
+	}
+	return time.Since(h.outageStart)
+}
+
+// Ready reports why the controller cannot yet provide up to date content, or nil if it can: its
+// informers must have synced every post and page into the store, and its watches must not have
+// been failing for longer than the maximum outage
+func (c *Controller) Ready() error {
+	select {
+	case <-c.synced:
+	default:
+		return errNotSynced
+	}
+	if outage := c.watch.outage(); outage > c.maxWatchOutage {
+		return fmt.Errorf("watches have been failing for %s", outage.Round(time.Second))
+	}
+	return nil
+}
+
+// handleHealthz answers liveness probes, which pass whenever the server is answering requests
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers readiness probes, which pass once the blog has its content and keeps it
+// up to date, so that a new pod receives traffic only once it can serve every post. Followers are
+// as ready as the leader, as every replica serves the blog; the response only reports which it is.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if s.stopping.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready: shutting down\n"))
+		return
+	}
+
+	if s.ready != nil {
+		if err := s.ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %v\n", err)
+			return
+		}
+	}
+
+	switch {
+	case s.leader == nil:
+		w.Write([]byte("ok\n"))
+	case s.leader():
+		w.Write([]byte("ok: leader\n"))
+	default:
+		w.Write([]byte("ok: follower\n"))
+	}
+}
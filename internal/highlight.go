@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// mermaidLanguage is the fenced code block language for mermaid diagrams, which are left for the
+// client to draw instead of being highlighted
+const mermaidLanguage = "mermaid"
+
+// mermaidAsset is the static asset holding the mermaid script, which draws diagrams in the browser
+// unless another URL is configured. It is vendored from a pinned release rather than loaded from a
+// CDN, so pages do not depend on a third party, along with its MIT licence. Without it, the server
+// refuses to start unless diagrams are disabled or another URL is configured.
+//
+//go:generate curl -fsSL -o templates/static/mermaid.min.js https://cdn.jsdelivr.net/npm/mermaid@11.4.1/dist/mermaid.min.js
+//go:generate curl -fsSL -o templates/static/mermaid.LICENSE https://cdn.jsdelivr.net/npm/mermaid@11.4.1/LICENSE
+const mermaidAsset = "mermaid.min.js"
+
+// DefaultCodeStyle is the colour scheme used for highlighted code when none is configured
+const DefaultCodeStyle = "github"
+
+// CodeStyles returns the names of the available code highlighting colour schemes
+func CodeStyles() []string {
+	names := styles.Names()
+	sort.Strings(names)
+	return names
+}
+
+// HighlightStyleSheet generates the CSS for highlighted code blocks using the named colour scheme
+func HighlightStyleSheet(styleName string) ([]byte, error) {
+	style, exists := styles.Registry[styleName]
+	if !exists {
+		return nil, fmt.Errorf("unknown code style %q", styleName)
+	}
+
+	var buf bytes.Buffer
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&buf, style); err != nil {
+		return nil, fmt.Errorf("failed to generate stylesheet for code style %q: %w", styleName, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fenceInfo holds the options parsed from a fenced code block's info string, for example
+// "go {3,5-7} linenos" highlights lines 3 and 5 to 7 of a Go block and shows line numbers
+type fenceInfo struct {
+	Language    string
+	Highlight   [][2]int
+	LineNumbers bool
+}
+
+// parseFenceInfo parses the info string of a fenced code block
+func parseFenceInfo(info string) fenceInfo {
+	var parsed fenceInfo
+
+	// Line ranges may contain spaces, so pull them out before splitting into fields
+	if start := strings.IndexByte(info, '{'); start >= 0 {
+		if end := strings.IndexByte(info[start:], '}'); end >= 0 {
+			parsed.Highlight = parseLineRanges(info[start+1 : start+end])
+			info = info[:start] + " " + info[start+end+1:]
+		}
+	}
+
+	for i, field := range strings.Fields(info) {
+		switch {
+		case field == "linenos":
+			parsed.LineNumbers = true
+		case i == 0:
+			parsed.Language = field
+		}
+	}
+
+	return parsed
+}
+
+// parseLineRanges parses a comma-separated list of line numbers and ranges such as "1,3-5",
+// ignoring any malformed entries
+func parseLineRanges(spec string) [][2]int {
+	var ranges [][2]int
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			continue
+		}
+
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || end < start {
+				continue
+			}
+		}
+
+		ranges = append(ranges, [2]int{start, end})
+	}
+
+	return ranges
+}
+
+// codeHighlighter renders fenced code blocks with language-aware syntax highlighting. Tokens are
+// emitted with CSS classes so the colour scheme is decided by the stylesheet from HighlightStyleSheet.
+type codeHighlighter struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer
+func (h *codeHighlighter) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, h.renderFencedCodeBlock)
+}
+
+// renderFencedCodeBlock renders a single fenced code block
+func (h *codeHighlighter) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	block := node.(*ast.FencedCodeBlock)
+
+	var info fenceInfo
+	if block.Info != nil {
+		info = parseFenceInfo(string(block.Info.Segment.Value(source)))
+	}
+
+	var code bytes.Buffer
+	lines := block.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code.Write(line.Value(source))
+	}
+
+	if info.Language == mermaidLanguage {
+		writeGenerated(w, node, []byte("<pre class=\"mermaid\">"+html.EscapeString(code.String())+"</pre>\n"))
+		return ast.WalkSkipChildren, nil
+	}
+
+	lexer := lexers.Get(info.Language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code.String())
+	if err != nil {
+		return ast.WalkStop, fmt.Errorf("failed to tokenise %s code block: %w", info.Language, err)
+	}
+
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(info.LineNumbers),
+		chromahtml.HighlightLines(info.Highlight),
+	)
+	var highlighted bytes.Buffer
+	if err := formatter.Format(&highlighted, styles.Fallback, iterator); err != nil {
+		return ast.WalkStop, fmt.Errorf("failed to format %s code block: %w", info.Language, err)
+	}
+
+	writeGenerated(w, node, highlighted.Bytes())
+	return ast.WalkSkipChildren, nil
+}
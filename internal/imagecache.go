@@ -0,0 +1,133 @@
+package internal
+
+import (
+	linkedlist "container/list"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// imageWorkers is the number of images resized at once, as each decoded image may take tens of
+// megabytes
+const imageWorkers = 2
+
+// imageVariant is a resized image
+type imageVariant struct {
+	ContentType string
+	Content     []byte
+	ETag        string
+}
+
+// variantKey identifies a variant by the content of the original, through its entity tag, along
+// with the width and format it was resized to
+type variantKey struct {
+	etag   string
+	width  int
+	format string
+}
+
+// String returns the key as a string, for deduplicating concurrent requests for a variant
+func (k variantKey) String() string {
+	return fmt.Sprintf("%s/%d/%s", k.etag, k.width, k.format)
+}
+
+// imageCache resizes images into variants, keeping the most recently used within a bound on
+// their total size. Variants of replaced or deleted assets are never requested again, so they
+// fall out of the cache in time.
+type imageCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *linkedlist.List                   // Variants from most to least recently used
+	entries  map[variantKey]*linkedlist.Element // Elements of order holding *cachedVariant
+	inFlight singleflight.Group                 // Deduplicates concurrent resizes of the same variant
+	workers  chan struct{}                      // Bounds the resizes running at once
+}
+
+// cachedVariant is an entry in the image cache
+type cachedVariant struct {
+	key     variantKey
+	variant *imageVariant
+}
+
+// newImageCache creates an image cache holding up to maxBytes of variants, or none if maxBytes is
+// not positive
+func newImageCache(maxBytes int64) *imageCache {
+	return &imageCache{
+		maxBytes: maxBytes,
+		order:    linkedlist.New(),
+		entries:  make(map[variantKey]*linkedlist.Element),
+		workers:  make(chan struct{}, imageWorkers),
+	}
+}
+
+// variant returns an asset resized to a width and encoded as format, resizing it if it is not
+// already cached
+func (c *imageCache) variant(asset *BlogAsset, width int, format string) (*imageVariant, error) {
+	key := variantKey{etag: asset.ETag, width: width, format: format}
+	if variant, found := c.get(key); found {
+		return variant, nil
+	}
+
+	result, err, _ := c.inFlight.Do(key.String(), func() (interface{}, error) {
+		c.workers <- struct{}{}
+		defer func() { <-c.workers }()
+
+		content, err := resizeImage(asset.Content, width, format)
+		if err != nil {
+			return nil, err
+		}
+
+		variant := &imageVariant{
+			ContentType: format,
+			Content:     content,
+			ETag:        fmt.Sprintf(`%s-%dw-%s"`, strings.TrimSuffix(asset.ETag, `"`), width, strings.TrimPrefix(format, "image/")),
+		}
+		c.put(key, variant)
+		return variant, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*imageVariant), nil
+}
+
+// get returns a cached variant, marking it as the most recently used
+func (c *imageCache) get(key variantKey) (*imageVariant, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cachedVariant).variant, true
+}
+
+// put caches a variant, evicting the least recently used variants to make room. Variants larger
+// than the whole cache are not cached.
+func (c *imageCache) put(key variantKey, variant *imageVariant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := int64(len(variant.Content))
+	if size > c.maxBytes {
+		return
+	}
+	if _, found := c.entries[key]; found {
+		return
+	}
+
+	for c.bytes+size > c.maxBytes {
+		oldest := c.order.Back()
+		evicted := c.order.Remove(oldest).(*cachedVariant)
+		delete(c.entries, evicted.key)
+		c.bytes -= int64(len(evicted.variant.Content))
+	}
+
+	c.entries[key] = c.order.PushFront(&cachedVariant{key: key, variant: variant})
+	c.bytes += size
+}
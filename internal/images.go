@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+)
+
+// DefaultImageWidths are the widths in pixels of the resized variants offered for images when none
+// are configured
+var DefaultImageWidths = []int{320, 640, 960, 1280, 1920}
+
+// DefaultImageSizes tells browsers how wide images are shown when nothing else is configured:
+// across the screen on small screens, and across the content column of the layout beyond that
+const DefaultImageSizes = "(max-width: 1280px) 100vw, 1216px"
+
+// DefaultImageCacheSize is the number of megabytes of resized image variants kept in memory when
+// none is configured
+const DefaultImageCacheSize = 64
+
+// maxImagePixels bounds the images decoded for resizing, which are served as they are beyond it
+const maxImagePixels = 50_000_000
+
+// variantJPEGQuality is the quality resized JPEG images are encoded at
+const variantJPEGQuality = 85
+
+// ImageOptions configures the resized variants of images served as BlogAssets that rendered
+// posts and pages offer
+type ImageOptions struct {
+	Widths []int  // Widths in pixels of the variants offered in srcset, or none to only offer originals
+	Sizes  string // The sizes attribute telling browsers how wide images are shown
+}
+
+// ParseImageWidths parses a comma-separated list of image widths in pixels
+func ParseImageWidths(value string) ([]int, error) {
+	var widths []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		width, err := strconv.Atoi(part)
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid image width %q", part)
+		}
+		widths = append(widths, width)
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// FormatImageWidths formats image widths as a comma-separated list, as ParseImageWidths parses
+func FormatImageWidths(widths []int) string {
+	parts := make([]string, len(widths))
+	for i, width := range widths {
+		parts[i] = strconv.Itoa(width)
+	}
+	return strings.Join(parts, ",")
+}
+
+// isResizableImage reports whether images of a media type can be resized
+func isResizableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// imageSrcSet returns the srcset attribute offering each width of an image served at url
+func imageSrcSet(url string, widths []int) string {
+	candidates := make([]string, len(widths))
+	for i, width := range widths {
+		candidates[i] = fmt.Sprintf("%s?w=%d %dw", url, width, width)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// variantFormat returns the media type a variant of an image is encoded as for a request: WebP
+// for PNG images when the client accepts it, whose lossless encoding beats PNG's, and otherwise
+// the image's own type. There is no lossy WebP or AVIF encoder in pure Go, so JPEG stays JPEG.
+func variantFormat(contentType string, r *http.Request) string {
+	if contentType == "image/png" && acceptsMediaType(r, "image/webp") {
+		return "image/webp"
+	}
+	return contentType
+}
+
+// acceptsMediaType reports whether a request's Accept header names a media type, ignoring
+// wildcards, which clients send whether or not they support newer formats
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		if key, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(key) == "q" {
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && quality == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// resizeImage decodes an image, scales it down to at most the given width with its EXIF
+// orientation applied, and encodes it as format. Images are never scaled up.
+func resizeImage(content []byte, width int, format string) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large to resize", config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Orientations from 5 onwards swap the image's width and height
+	orientation := jpegOrientation(content)
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	shownWidth, shownHeight := srcWidth, srcHeight
+	if orientation >= 5 {
+		shownWidth, shownHeight = srcHeight, srcWidth
+	}
+
+	width = min(width, shownWidth)
+	height := max(1, shownHeight*width/shownWidth)
+	scaledWidth, scaledHeight := width, height
+	if orientation >= 5 {
+		scaledWidth, scaledHeight = height, width
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+	oriented := orientImage(scaled, orientation)
+
+	// Encoding afresh leaves the metadata of the original behind
+	var buf bytes.Buffer
+	switch format {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, oriented, &jpeg.Options{Quality: variantJPEGQuality})
+	case "image/png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, oriented)
+	case "image/webp":
+		err = nativewebp.Encode(&buf, oriented, nil)
+	default:
+		err = fmt.Errorf("unsupported image format %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// orientImage rotates and flips an image according to its EXIF orientation, so that it is shown
+// the right way up without its metadata
+func orientImage(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise to be shown
+				dx, dy = height-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // Rotated 90° anticlockwise to be shown
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// stripImageMetadata removes metadata such as EXIF, which may record where and with what a photo
+// was taken, from JPEG and PNG images, keeping the JPEG orientation so that photos are still shown
+// the right way up. Other content, or content that cannot be parsed, is returned unchanged.
+func stripImageMetadata(contentType string, content []byte) []byte {
+	var stripped []byte
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		stripped, err = stripJPEGMetadata(content)
+	case "image/png":
+		stripped, err = stripPNGMetadata(content)
+	default:
+		return content
+	}
+	if err != nil {
+		return content
+	}
+	return stripped
+}
+
+// JPEG markers read when stripping metadata
+const (
+	jpegSOI  = 0xd8 // Start of image
+	jpegSOS  = 0xda // Start of scan, after which the compressed image data follows
+	jpegAPP1 = 0xe1 // EXIF and XMP metadata
+	jpegAPPD = 0xed // Photoshop and IPTC metadata
+	jpegCOM  = 0xfe // Comment
+)
+
+// exifOrientationTag is the EXIF tag recording how a photo must be rotated to be shown
+const exifOrientationTag = 0x0112
+
+// stripJPEGMetadata removes the EXIF, XMP, IPTC and comment segments of a JPEG, replacing any
+// EXIF with a minimal segment holding just the orientation. Colour profiles are kept.
+func stripJPEGMetadata(content []byte) ([]byte, error) {
+	if len(content) < 4 || content[0] != 0xff || content[1] != jpegSOI {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+
+	out := make([]byte, 0, len(content))
+	out = append(out, content[:2]...)
+	if orientation := jpegOrientation(content); orientation > 1 {
+		out = append(out, exifOrientationSegment(orientation)...)
+	}
+
+	for offset := 2; offset+4 <= len(content); {
+		if content[offset] != 0xff {
+			return nil, fmt.Errorf("invalid JPEG marker at offset %d", offset)
+		}
+		marker := content[offset+1]
+		if marker == jpegSOS {
+			return append(out, content[offset:]...), nil
+		}
+
+		// A segment's length counts the two bytes holding it
+		length := int(binary.BigEndian.Uint16(content[offset+2:]))
+		if length < 2 {
+			return nil, fmt.Errorf("invalid JPEG segment length at offset %d", offset)
+		}
+		end := offset + 2 + length
+		if end > len(content) {
+			return nil, fmt.Errorf("truncated JPEG segment at offset %d", offset)
+		}
+		if marker != jpegAPP1 && marker != jpegAPPD && marker != jpegCOM {
+			out = append(out, content[offset:end]...)
+		}
+		offset = end
+	}
+	return nil, fmt.Errorf("JPEG has no image data")
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, from 1 to 8, or 1 if it has none
+func jpegOrientation(content []byte) int {
+	if len(content) < 4 || content[0] != 0xff || content[1] != jpegSOI {
+		return 1
+	}
+
+	for offset := 2; offset+4 <= len(content); {
+		if content[offset] != 0xff || content[offset+1] == jpegSOS {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(content[offset+2:]))
+		end := offset + 2 + length
+		if length < 2 || end > len(content) {
+			return 1
+		}
+		if content[offset+1] == jpegAPP1 {
+			if orientation, found := exifOrientation(content[offset+4 : end]); found {
+				return orientation
+			}
+		}
+		offset = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation from the first image directory of an EXIF segment
+func exifOrientation(segment []byte) (int, bool) {
+	tiff, isExif := bytes.CutPrefix(segment, []byte("Exif\x00\x00"))
+	if !isExif || len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	directory := int(order.Uint32(tiff[4:]))
+	if directory+2 > len(tiff) {
+		return 0, false
+	}
+	entries := int(order.Uint16(tiff[directory:]))
+	for i := 0; i < entries; i++ {
+		entry := directory + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			return orientation, orientation >= 1 && orientation <= 8
+		}
+	}
+	return 0, false
+}
+
+// exifOrientationSegment builds a JPEG APP1 segment holding an EXIF directory with only the
+// orientation in it
+func exifOrientationSegment(orientation int) []byte {
+	var tiff []byte
+	tiff = append(tiff, "MM\x00\x2a"...)          // Big-endian TIFF header
+	tiff = binary.BigEndian.AppendUint32(tiff, 8) // Offset of the first directory
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // Number of entries
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1) // Count
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = binary.BigEndian.AppendUint16(tiff, 0) // Padding of the value field
+	tiff = binary.BigEndian.AppendUint32(tiff, 0) // No further directories
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, jpegAPP1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngMetadataChunks are the PNG chunks holding metadata rather than the image
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata removes the text, EXIF and timestamp chunks of a PNG
+func stripPNGMetadata(content []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(content, []byte(signature)) {
+		return nil, fmt.Errorf("not a PNG")
+	}
+
+	out := make([]byte, 0, len(content))
+	out = append(out, signature...)
+	for offset := len(signature); offset < len(content); {
+		if offset+8 > len(content) {
+			return nil, fmt.Errorf("truncated PNG chunk at offset %d", offset)
+		}
+		end := offset + 12 + int(binary.BigEndian.Uint32(content[offset:]))
+		if end > len(content) || end < offset {
+			return nil, fmt.Errorf("truncated PNG chunk at offset %d", offset)
+		}
+		if !pngMetadataChunks[string(content[offset+4:offset+8])] {
+			out = append(out, content[offset:end]...)
+		}
+		offset = end
+	}
+	return out, nil
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testJPEG encodes a JPEG of the given size with the segments inserted after its start of image
+func testJPEG(t *testing.T, width, height int, segments ...[]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	content := append([]byte{}, encoded[:2]...)
+	for _, segment := range segments {
+		content = append(content, segment...)
+	}
+	return append(content, encoded[2:]...)
+}
+
+// jpegSegment builds a JPEG segment with the given marker and payload
+func jpegSegment(marker byte, payload string) []byte {
+	segment := []byte{0xff, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// littleEndianExif builds the payload of an EXIF segment in Intel byte order holding only an
+// orientation
+func littleEndianExif(orientation uint16) string {
+	var tiff []byte
+	tiff = append(tiff, "II\x2a\x00"...)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+	return "Exif\x00\x00" + string(tiff)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		content := testJPEG(t, 4, 2, exifOrientationSegment(orientation))
+		if got := jpegOrientation(content); got != orientation {
+			t.Errorf("expected orientation %d, got %d", orientation, got)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+	}{
+		{name: "no EXIF", content: testJPEG(t, 4, 2), want: 1},
+		{name: "little-endian EXIF", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, littleEndianExif(6))), want: 6},
+		{name: "XMP before EXIF", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, "http://ns.adobe.com/xap/1.0/\x00"), exifOrientationSegment(8)), want: 8},
+		{name: "orientation out of range", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, littleEndianExif(9))), want: 1},
+		{name: "not a JPEG", content: []byte("GIF89a"), want: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := jpegOrientation(test.content); got != test.want {
+				t.Errorf("expected orientation %d, got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// Where the top-left pixel of a 3x2 image is shown, and the size it is shown at
+	tests := []struct {
+		orientation           int
+		wantX, wantY          int
+		wantWidth, wantHeight int
+	}{
+		{orientation: 1, wantX: 0, wantY: 0, wantWidth: 3, wantHeight: 2},
+		{orientation: 2, wantX: 2, wantY: 0, wantWidth: 3, wantHeight: 2},
+		{orientation: 3, wantX: 2, wantY: 1, wantWidth: 3, wantHeight: 2},
+		{orientation: 4, wantX: 0, wantY: 1, wantWidth: 3, wantHeight: 2},
+		{orientation: 5, wantX: 0, wantY: 0, wantWidth: 2, wantHeight: 3},
+		{orientation: 6, wantX: 1, wantY: 0, wantWidth: 2, wantHeight: 3},
+		{orientation: 7, wantX: 1, wantY: 2, wantWidth: 2, wantHeight: 3},
+		{orientation: 8, wantX: 0, wantY: 2, wantWidth: 2, wantHeight: 3},
+	}
+
+	marked := color.NRGBA{R: 255, A: 255}
+	for _, test := range tests {
+		src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+		src.SetNRGBA(0, 0, marked)
+
+		dst := orientImage(src, test.orientation)
+		if dst.Bounds().Dx() != test.wantWidth || dst.Bounds().Dy() != test.wantHeight {
+			t.Errorf("orientation %d: expected %dx%d, got %dx%d", test.orientation,
+				test.wantWidth, test.wantHeight, dst.Bounds().Dx(), dst.Bounds().Dy())
+			continue
+		}
+		if dst.NRGBAAt(test.wantX, test.wantY) != marked {
+			t.Errorf("orientation %d: expected the top-left pixel at (%d, %d)", test.orientation, test.wantX, test.wantY)
+		}
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	// The payload of an EXIF segment with more than the orientation after it
+	exif := string(exifOrientationSegment(6)[4:])
+	content := testJPEG(t, 4, 2,
+		jpegSegment(jpegAPP1, exif+"GPS secret"),
+		jpegSegment(jpegAPP1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>XMP secret</x:xmpmeta>"),
+		jpegSegment(0xe2, "ICC_PROFILE\x00\x01\x01profile"),
+		jpegSegment(jpegAPPD, "Photoshop 3.0\x00IPTC secret"),
+		jpegSegment(jpegCOM, "comment secret"),
+	)
+
+	stripped := stripImageMetadata("image/jpeg", content)
+	if bytes.Contains(stripped, []byte("secret")) {
+		t.Errorf("expected metadata to be removed")
+	}
+	if !bytes.Contains(stripped, []byte("ICC_PROFILE\x00\x01\x01profile")) {
+		t.Errorf("expected the colour profile to be kept")
+	}
+	if orientation := jpegOrientation(stripped); orientation != 6 {
+		t.Errorf("expected orientation 6 to be kept, got %d", orientation)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("failed to decode stripped JPEG: %v", err)
+	}
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 2 {
+		t.Errorf("expected a 4x2 image, got %v", img.Bounds())
+	}
+}
+
+// pngChunk builds a PNG chunk with its checksum
+func pngChunk(chunkType, data string) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType+data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE([]byte(chunkType+data)))
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	// Insert the chunks after the signature and IHDR, which is 25 bytes long
+	headerEnd := 8 + 25
+	var content []byte
+	content = append(content, encoded[:headerEnd]...)
+	content = append(content, pngChunk("iCCP", "profile\x00\x00compressed")...)
+	content = append(content, pngChunk("tEXt", "Author\x00text secret")...)
+	content = append(content, pngChunk("eXIf", "MM\x00\x2aEXIF secret")...)
+	content = append(content, pngChunk("tIME", "\x07\xe8\x01\x01\x00\x00\x00")...)
+	content = append(content, encoded[headerEnd:]...)
+
+	stripped := stripImageMetadata("image/png", content)
+	if bytes.Contains(stripped, []byte("secret")) || bytes.Contains(stripped, []byte("tIME")) {
+		t.Errorf("expected metadata to be removed")
+	}
+	if !bytes.Contains(stripped, []byte("iCCPprofile")) {
+		t.Errorf("expected the colour profile to be kept")
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("failed to decode stripped PNG: %v", err)
+	}
+}
+
+func TestMalformedImages(t *testing.T) {
+	valid := testJPEG(t, 4, 2)
+	soi := string(valid[:2])
+
+	tests := []struct {
+		name        string
+		contentType string
+		content     []byte
+		badExifOnly bool // The segments are valid and only the EXIF in them is not, so the rest is stripped
+	}{
+		{name: "empty JPEG", contentType: "image/jpeg", content: nil},
+		{name: "start of image only", contentType: "image/jpeg", content: []byte(soi)},
+		{name: "segment length 0", contentType: "image/jpeg", content: []byte(soi + "\xff\xe1\x00\x00Exif\x00\x00")},
+		{name: "segment length 1", contentType: "image/jpeg", content: []byte(soi + "\xff\xe1\x00\x01Exif\x00\x00")},
+		{name: "segment length 0 before image data", contentType: "image/jpeg", content: append([]byte(soi+"\xff\xe0\x00\x00"), valid[2:]...)},
+		{name: "truncated segment", contentType: "image/jpeg", content: []byte(soi + "\xff\xe1\x10\x00Exif")},
+		{name: "truncated image", contentType: "image/jpeg", content: valid[:len(valid)/2]},
+		{name: "invalid marker", contentType: "image/jpeg", content: []byte(soi + "\x00\xe1\x00\x08Exif\x00\x00")},
+		{name: "no image data", contentType: "image/jpeg", content: []byte(soi + "\xff\xfe\x00\x04hi")},
+		{name: "EXIF directory beyond the segment", contentType: "image/jpeg", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, "Exif\x00\x00MM\x00\x2a\xff\xff\xff\xff")), badExifOnly: true},
+		{name: "EXIF entries beyond the segment", contentType: "image/jpeg", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, "Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\xff\xff")), badExifOnly: true},
+		{name: "EXIF header only", contentType: "image/jpeg", content: testJPEG(t, 4, 2, jpegSegment(jpegAPP1, "Exif\x00\x00MM")), badExifOnly: true},
+		{name: "truncated PNG chunk", contentType: "image/png", content: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")},
+		{name: "PNG chunk length overflow", contentType: "image/png", content: []byte("\x89PNG\r\n\x1a\n\xff\xff\xff\xffIHDR")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// None of these may panic, and content that cannot be parsed is kept as it is
+			resizeImage(test.content, 2, test.contentType)
+			stripped := stripImageMetadata(test.contentType, test.content)
+			if test.contentType == "image/jpeg" {
+				if orientation := jpegOrientation(test.content); orientation != 1 {
+					t.Errorf("expected orientation 1, got %d", orientation)
+				}
+				if test.badExifOnly {
+					return
+				}
+				if _, err := stripJPEGMetadata(test.content); err == nil {
+					t.Errorf("expected an error")
+				}
+			}
+			if !bytes.Equal(stripped, test.content) {
+				t.Errorf("expected malformed content to be returned unchanged")
+			}
+		})
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	tests := []struct {
+		name                  string
+		content               []byte
+		width                 int
+		wantWidth, wantHeight int
+	}{
+		{name: "scaled down", content: testJPEG(t, 40, 20), width: 10, wantWidth: 10, wantHeight: 5},
+		{name: "never scaled up", content: testJPEG(t, 40, 20), width: 100, wantWidth: 40, wantHeight: 20},
+		{name: "rotated by its orientation", content: testJPEG(t, 40, 20, exifOrientationSegment(6)), width: 10, wantWidth: 10, wantHeight: 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resized, err := resizeImage(test.content, test.width, "image/jpeg")
+			if err != nil {
+				t.Fatalf("failed to resize: %v", err)
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(resized))
+			if err != nil {
+				t.Fatalf("failed to decode resized image: %v", err)
+			}
+			if config.Width != test.wantWidth || config.Height != test.wantHeight {
+				t.Errorf("expected %dx%d, got %dx%d", test.wantWidth, test.wantHeight, config.Width, config.Height)
+			}
+			if jpegOrientation(resized) != 1 {
+				t.Errorf("expected the resized image to have no orientation left to apply")
+			}
+		})
+	}
+}
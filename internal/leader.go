@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// DefaultLeaseName is the name of the Lease replicas compete for when leader election is enabled
+const DefaultLeaseName = "bloggernetes"
+
+// Timings of leader election. A leader that cannot renew its Lease within the renew deadline stops
+// writing, and another replica may take over once the lease duration has passed without a renewal.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// LeaderElectionOptions configures the election of the one replica that writes to the cluster. Every
+// replica watches and serves the blog regardless.
+type LeaderElectionOptions struct {
+	Client    kubernetes.Interface // Client for the Lease
+	Namespace string               // Namespace of the Lease
+	LeaseName string               // Name of the Lease
+
+	// Identity distinguishes this replica from the others, defaulting to its hostname, which is
+	// the pod's name in Kubernetes, with a random suffix
+	Identity string
+}
+
+// IsLeader reports whether this replica may write to the cluster, which it always may when leader
+// election is disabled
+func (c *Controller) IsLeader() bool {
+	if c.leaderElection == nil {
+		return true
+	}
+	return c.leader.Load()
+}
+
+// runLeaderElection competes for leadership until the controller stops, standing again whenever it
+// loses it. On becoming leader it reconciles every resource again to write their statuses, as the
+// writes were skipped while another replica led.
+func (c *Controller) runLeaderElection(ctx context.Context, options LeaderElectionOptions) error {
+	identity, err := leaderIdentity(options.Identity)
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      options.LeaseName,
+			Namespace: options.Namespace,
+		},
+		Client: options.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	config := leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		// Hand over at once on shutdown, rather than leaving the others to wait for the lease to expire
+		ReleaseOnCancel: true,
+		Name:            options.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info("Became leader", "lease", options.LeaseName, "identity", identity)
+				c.leader.Store(true)
+				recordLeader(true)
+				c.enqueueAll()
+			},
+			OnStoppedLeading: func() {
+				if c.leader.Swap(false) {
+					log.Info("Stopped leading", "lease", options.LeaseName, "identity", identity)
+				}
+				recordLeader(false)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Info("Following leader", "lease", options.LeaseName, "leader", leader)
+				}
+			},
+		},
+	}
+
+	log.Info("Starting leader election", "lease", options.LeaseName, "identity", identity)
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(config)
+		if err != nil {
+			return fmt.Errorf("failed to create leader elector: %w", err)
+		}
+
+		// Run returns once leadership is lost or the context is cancelled
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// leaderIdentity returns the identity a replica stands for leadership under: the configured one,
+// or the hostname with a random suffix, so that processes sharing a host outside Kubernetes differ
+func leaderIdentity(identity string) (string, error) {
+	if identity != "" {
+		return identity, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine leader election identity: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to determine leader election identity: %w", err)
+	}
+	return hostname + "_" + hex.EncodeToString(suffix), nil
+}
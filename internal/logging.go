@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats logs can be written in
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// DefaultLogFormat is the log format used when none is configured
+const DefaultLogFormat = LogFormatText
+
+// DefaultLogLevel is the least severe level of message logged when none is configured
+const DefaultLogLevel = "info"
+
+// requestIDHeader carries the ID of a request, which is taken from the request if a proxy in front
+// of the blog has assigned one and echoed in the response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length beyond which request IDs from clients are replaced
+const maxRequestIDLength = 128
+
+// LogFormats returns the names of the supported log formats
+func LogFormats() []string {
+	return []string{LogFormatText, LogFormatJSON}
+}
+
+// LogLevels returns the names of the supported log levels, from most to least verbose
+func LogLevels() []string {
+	return []string{"debug", "info", "warn", "error"}
+}
+
+// ConfigureLogging sets the format of log messages and the least severe level logged
+func ConfigureLogging(format, level string) error {
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("unknown log level %q, must be one of: %s", level, strings.Join(LogLevels(), ", "))
+	}
+
+	var formatter log.Formatter
+	switch format {
+	case LogFormatText:
+		formatter = log.TextFormatter
+	case LogFormatJSON:
+		formatter = log.JSONFormatter
+	default:
+		return fmt.Errorf("unknown log format %q, must be one of: %s", format, strings.Join(LogFormats(), ", "))
+	}
+
+	logger := log.NewWithOptions(os.Stderr, log.Options{
+		Level:           logLevel,
+		Formatter:       formatter,
+		ReportTimestamp: true,
+		TimeFormat:      time.RFC3339,
+	})
+	log.SetDefault(logger)
+	return nil
+}
+
+// requestIDKey is the request context key holding the request's ID
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID of a request, or an empty string if it has none
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the ID a proxy assigned to a request, or generates one if it has none or the
+// one it has is unsafe to log
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// isPrintableASCII reports whether a string only contains printable ASCII characters
+func isPrintableASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' || value[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog returns a middleware that assigns each request an ID, traces it and logs it once it
+// has been answered, with its status, size and duration. Requests for the metrics and probes,
+// which are made every few seconds when served alongside the blog, are only logged at debug level.
+func accessLog() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := requestID(r)
+			w.Header().Set(requestIDHeader, id)
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+
+			ctx, span := startRequestSpan(ctx, r)
+			defer span.End()
+
+			rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+			endRequestSpan(span, rw.status)
+
+			fields := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rw.status,
+				"bytes", rw.bytes,
+				"duration", time.Since(start),
+				"request_id", id,
+			}
+			if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+				fields = append(fields, "trace_id", spanContext.TraceID().String())
+			}
+			if isAdminPath(r.URL.Path) {
+				log.Debug("Request", fields...)
+			} else {
+				log.Info("Request", fields...)
+			}
+		})
+	}
+}
+
+// isAdminPath reports whether a path is one of the admin routes, for scraping metrics and probing
+// the blog's health
+func isAdminPath(path string) bool {
+	switch path {
+	case metricsPath, healthzPath, readyzPath:
+		return true
+	}
+	return false
+}
+
+// responseRecorder records the status and size of a response for logging
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
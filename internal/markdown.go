@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"unicode"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// wordsPerMinute is the average reading speed used to estimate reading time
+const wordsPerMinute = 200
+
+// TOCEntry is a heading in a rendered document's table of contents
+type TOCEntry struct {
+	ID       string
+	Title    string
+	Level    int
+	Children []*TOCEntry
+}
+
+// RenderedMarkdown holds the HTML and metadata produced by rendering a Markdown document
+type RenderedMarkdown struct {
+	HTML       template.HTML
+	TOC        []*TOCEntry
+	PlainText  string // The prose of the document without markup or code, for excerpts
+	WordCount  int
+	HasMath    bool     // Whether the document contains $...$ or $$...$$ math
+	HasMermaid bool     // Whether the document contains mermaid diagrams, which are drawn client-side
+	Errors     []string // Problems such as unknown shortcodes, which are also shown in the HTML
+}
+
+// ReadingTime returns the estimated reading time in minutes, rounded up
+func (r *RenderedMarkdown) ReadingTime() int {
+	if r.WordCount == 0 {
+		return 0
+	}
+	return (r.WordCount + wordsPerMinute - 1) / wordsPerMinute
+}
+
+// Renderer renders Markdown documents to HTML on the server
+type Renderer struct {
+	markdown goldmark.Markdown
+	policy   *bluemonday.Policy // Applied to author content, or nil if authors are trusted
+	images   ImageOptions
+}
+
+// NewRenderer creates a new Markdown renderer supporting the given shortcodes, which treats raw
+// HTML written by authors according to the named HTML policy and offers resized variants of
+// images served as BlogAssets
+func NewRenderer(shortcodes ShortcodeRegistry, htmlPolicy string, images ImageOptions) (*Renderer, error) {
+	shortcodeRenderer := &shortcodeRenderer{images: images}
+	rendererOptions := []renderer.Option{
+		// Take priority over the default HTML renderer's handling of fenced code blocks
+		renderer.WithNodeRenderers(
+			util.Prioritized(&codeHighlighter{}, 100),
+			util.Prioritized(&mathRenderer{}, 500),
+			util.Prioritized(shortcodeRenderer, 500),
+		),
+	}
+
+	var policy *bluemonday.Policy
+	switch htmlPolicy {
+	case HTMLPolicyTrusted:
+		rendererOptions = append(rendererOptions, html.WithUnsafe())
+	case HTMLPolicySanitized:
+		policy = newSanitizerPolicy()
+		rendererOptions = append(rendererOptions, html.WithUnsafe())
+	case HTMLPolicyStrict:
+		// Without html.WithUnsafe, raw HTML is omitted from the output
+		policy = newSanitizerPolicy()
+	default:
+		return nil, fmt.Errorf("unknown HTML policy %q", htmlPolicy)
+	}
+
+	markdown := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+			parser.WithInlineParsers(util.Prioritized(&mathInlineParser{}, 500)),
+			parser.WithBlockParsers(
+				util.Prioritized(&mathBlockParser{}, 700),
+				util.Prioritized(&shortcodeParser{registry: shortcodes}, 700),
+			),
+			parser.WithASTTransformers(
+				util.Prioritized(&blogAssetLinkTransformer{images: images}, 400),
+				util.Prioritized(&externalLinkTransformer{}, 500),
+			),
+		),
+		goldmark.WithRendererOptions(rendererOptions...),
+	)
+	shortcodeRenderer.markdown = markdown
+
+	return &Renderer{markdown: markdown, policy: policy, images: images}, nil
+}
+
+// Render renders a Markdown document, extracting its table of contents and word count
+func (r *Renderer) Render(source string) (*RenderedMarkdown, error) {
+	src := []byte(source)
+	doc := r.markdown.Parser().Parse(text.NewReader(src))
+
+	var s *sanitization
+	if r.policy != nil {
+		var err error
+		if s, err = newSanitization(r.policy); err != nil {
+			return nil, err
+		}
+		doc.OwnerDocument().AddMeta(sanitizationKey, s)
+	}
+
+	var buf bytes.Buffer
+	if err := r.markdown.Renderer().Render(&buf, src, doc); err != nil {
+		return nil, fmt.Errorf("failed to render markdown: %w", err)
+	}
+
+	output := buf.Bytes()
+	if s != nil {
+		output = s.restore(s.sanitize(output))
+	}
+
+	rendered := &RenderedMarkdown{
+		HTML:      template.HTML(output),
+		TOC:       extractTOC(doc, src),
+		PlainText: proseText(doc, src),
+		WordCount: countWords(doc, src),
+	}
+	detectFeatures(rendered, doc, src)
+	rendered.Errors = shortcodeErrors(doc)
+
+	return rendered, nil
+}
+
+// detectFeatures records which optional features the document uses, so pages only load the
+// assets they need
+func detectFeatures(rendered *RenderedMarkdown, doc ast.Node, src []byte) {
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *mathInline, *mathBlock:
+			rendered.HasMath = true
+		case *ast.FencedCodeBlock:
+			if n.Info != nil && parseFenceInfo(string(n.Info.Segment.Value(src))).Language == mermaidLanguage {
+				rendered.HasMermaid = true
+			}
+		}
+
+		return ast.WalkContinue, nil
+	})
+}
+
+// extractTOC builds a tree of the document's headings, nesting each heading beneath the
+// closest preceding heading of a higher level
+func extractTOC(doc ast.Node, src []byte) []*TOCEntry {
+	var toc []*TOCEntry
+	var stack []*TOCEntry
+
+	for node := doc.FirstChild(); node != nil; node = node.NextSibling() {
+		heading, ok := node.(*ast.Heading)
+		if !ok {
+			continue
+		}
+
+		entry := &TOCEntry{
+			Title: plainText(heading, src),
+			Level: heading.Level,
+		}
+		if id, ok := heading.AttributeString("id"); ok {
+			if idBytes, ok := id.([]byte); ok {
+				entry.ID = string(idBytes)
+			}
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].Level >= entry.Level {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) == 0 {
+			toc = append(toc, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, entry)
+		}
+		stack = append(stack, entry)
+	}
+
+	return toc
+}
+
+// countWords counts the words of prose in the document, excluding code blocks
+func countWords(doc ast.Node, src []byte) int {
+	count := 0
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			count += wordsIn(string(n.Segment.Value(src)))
+		case *ast.String:
+			count += wordsIn(string(n.Value))
+		}
+
+		return ast.WalkContinue, nil
+	})
+
+	return count
+}
+
+// wordsIn counts the whitespace-separated words in s that contain at least one letter or digit
+func wordsIn(s string) int {
+	count := 0
+	for _, field := range strings.Fields(s) {
+		if strings.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// proseText returns the text of the document's prose with whitespace collapsed, separating
+// blocks with a space and leaving out code blocks and raw HTML
+func proseText(doc ast.Node, src []byte) string {
+	var sb strings.Builder
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			if node.Type() == ast.TypeBlock {
+				sb.WriteByte(' ')
+			}
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			sb.Write(n.Segment.Value(src))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				sb.WriteByte(' ')
+			}
+		case *ast.String:
+			sb.Write(n.Value)
+		}
+
+		return ast.WalkContinue, nil
+	})
+
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// plainText returns the concatenated text content of a node's descendants
+func plainText(node ast.Node, src []byte) string {
+	var sb strings.Builder
+
+	ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch t := n.(type) {
+		case *ast.Text:
+			sb.Write(t.Segment.Value(src))
+			if t.SoftLineBreak() || t.HardLineBreak() {
+				sb.WriteByte(' ')
+			}
+		case *ast.String:
+			sb.Write(t.Value)
+		}
+
+		return ast.WalkContinue, nil
+	})
+
+	return sb.String()
+}
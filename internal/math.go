@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/wyatt915/treeblood"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// KindMath and KindMathBlock are the AST node kinds for inline ($...$) and display ($$...$$) math
+var (
+	KindMath      = ast.NewNodeKind("Math")
+	KindMathBlock = ast.NewNodeKind("MathBlock")
+)
+
+// mathMLPolicy is the allow-list applied to converted math. The converter writes the text of
+// commands such as \text{} and \class{} without escaping it, so anything beyond the MathML it
+// generates came from the author and is removed.
+var mathMLPolicy = newMathMLPolicy()
+
+// newMathMLPolicy builds the allow-list of MathML elements, attributes and styles the converter
+// generates
+func newMathMLPolicy() *bluemonday.Policy {
+	elements := []string{
+		"math", "semantics", "annotation", "mrow", "mi", "mn", "mo", "mtext", "mspace", "mstyle",
+		"mpadded", "merror", "mfrac", "msqrt", "mroot", "msub", "msup", "msubsup", "munder", "mover",
+		"munderover", "mmultiscripts", "mprescripts", "none", "menclose", "mtable", "mtr", "mtd",
+		"mlabeledtr",
+	}
+
+	policy := bluemonday.NewPolicy()
+	policy.AllowNoAttrs().OnElements(elements...)
+	policy.AllowAttrs(
+		"accent", "columnalign", "columnlines", "columnspan", "display", "displaystyle", "encoding",
+		"fence", "form", "height", "intent", "largeop", "linebreak", "linethickness", "lspace",
+		"mathcolor", "mathsize", "mathvariant", "minsize", "movablelimits", "notation", "rowalign",
+		"rowspacing", "rowspan", "rspace", "scriptlevel", "stretchy", "symmetric", "title", "voffset",
+		"width", "xmlns",
+	).OnElements(elements...)
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^[\w\s-]+$`)).OnElements(elements...)
+	policy.AllowStyles(
+		"background-color", "border-bottom", "border-top", "padding", "padding-left", "padding-right",
+		"text-align",
+	).OnElements(elements...)
+	policy.AllowStyles("font-feature-settings").MatchingEnum("'dtls' off").OnElements("math")
+
+	return policy
+}
+
+// mathInline is an inline TeX expression, which is rendered as display math if it was written
+// with double dollars inside a paragraph
+type mathInline struct {
+	ast.BaseInline
+	TeX     []byte
+	Display bool
+}
+
+// Kind implements ast.Node
+func (n *mathInline) Kind() ast.NodeKind { return KindMath }
+
+// Dump implements ast.Node
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.TeX)}, nil)
+}
+
+// mathBlock is a display TeX expression spanning one or more lines between $$ delimiters
+type mathBlock struct {
+	ast.BaseBlock
+	closed bool
+}
+
+// Kind implements ast.Node
+func (n *mathBlock) Kind() ast.NodeKind { return KindMathBlock }
+
+// IsRaw implements ast.Node
+func (n *mathBlock) IsRaw() bool { return true }
+
+// Dump implements ast.Node
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// mathInlineParser parses $...$ and $$...$$ within a line. To avoid treating prices as math, the
+// opening dollar must be followed by a non-space, and the closing dollar must follow a non-space
+// and not be followed by a digit.
+type mathInlineParser struct{}
+
+// Trigger implements parser.InlineParser
+func (p *mathInlineParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Parse implements parser.InlineParser
+func (p *mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+
+	delimiter := []byte("$")
+	if bytes.HasPrefix(line, []byte("$$")) {
+		delimiter = []byte("$$")
+	}
+
+	start := len(delimiter)
+	if start >= len(line) || util.IsSpace(line[start]) {
+		return nil
+	}
+
+	for i := start; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++ // Skip escaped characters such as \$
+		case len(delimiter) == 1 && bytes.HasPrefix(line[i:], []byte("$$")):
+			i++ // Double dollars cannot close single dollar math
+		case bytes.HasPrefix(line[i:], delimiter):
+			end := i + len(delimiter)
+			if util.IsSpace(line[i-1]) || end < len(line) && util.IsNumeric(line[end]) {
+				continue
+			}
+
+			block.Advance(end)
+			return &mathInline{
+				TeX:     append([]byte(nil), line[start:i]...),
+				Display: len(delimiter) == 2,
+			}
+		}
+	}
+
+	return nil
+}
+
+// mathBlockParser parses display math blocks opened and closed by $$ lines
+type mathBlockParser struct{}
+
+// Trigger implements parser.BlockParser
+func (p *mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Open implements parser.BlockParser
+func (p *mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !bytes.HasPrefix(line[pos:], []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+
+	node := &mathBlock{}
+	rest := util.TrimRightSpace(line[pos+2:])
+	if len(rest) == 0 {
+		return node, parser.NoChildren
+	}
+
+	// A single line of $$...$$ is a whole block, anything else on the opening line is its first line
+	start := segment.Start + pos + 2
+	if bytes.HasSuffix(rest, []byte("$$")) {
+		node.Lines().Append(text.NewSegment(start, start+len(rest)-2))
+		node.closed = true
+	} else {
+		node.Lines().Append(text.NewSegment(start, segment.Stop))
+	}
+	reader.Advance(segment.Len() - trailingNewlineLength(line))
+
+	return node, parser.NoChildren
+}
+
+// Continue implements parser.BlockParser
+func (p *mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	block := node.(*mathBlock)
+	if block.closed {
+		return parser.Close
+	}
+
+	line, segment := reader.PeekLine()
+	if line == nil {
+		return parser.Close
+	}
+
+	trimmed := util.TrimRightSpace(line)
+	if bytes.HasSuffix(trimmed, []byte("$$")) {
+		if content := len(trimmed) - 2; content > 0 {
+			block.Lines().Append(text.NewSegment(segment.Start, segment.Start+content))
+		}
+		reader.Advance(segment.Len() - trailingNewlineLength(line))
+		return parser.Close
+	}
+
+	block.Lines().Append(segment)
+	reader.Advance(segment.Len() - trailingNewlineLength(line))
+	return parser.Continue | parser.NoChildren
+}
+
+// trailingNewlineLength returns the length of the newline ending line, which the parser consumes itself
+func trailingNewlineLength(line []byte) int {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		return 1
+	}
+	return 0
+}
+
+// Close implements parser.BlockParser
+func (p *mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+// CanInterruptParagraph implements parser.BlockParser
+func (p *mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+// CanAcceptIndentedLine implements parser.BlockParser
+func (p *mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// mathRenderer renders math nodes to MathML, which browsers display without any scripts. TeX that
+// fails to convert is shown as-is so the author can spot the mistake.
+type mathRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer
+func (r *mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindMath, r.renderMath)
+	reg.Register(KindMathBlock, r.renderMathBlock)
+}
+
+// renderMath renders an inline math node
+func (r *mathRenderer) renderMath(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*mathInline)
+		writeGenerated(w, node, mathML(string(n.TeX), n.Display))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// renderMathBlock renders a display math block
+func (r *mathRenderer) renderMathBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	var tex bytes.Buffer
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		tex.Write(line.Value(source))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("<div class=\"math-display\">")
+	out.Write(mathML(tex.String(), true))
+	out.WriteString("</div>\n")
+
+	writeGenerated(w, node, out.Bytes())
+	return ast.WalkSkipChildren, nil
+}
+
+// mathML converts TeX to sanitized MathML, falling back to the escaped TeX on failure
+func mathML(tex string, display bool) []byte {
+	converted, err := treeblood.TexToMML(tex, nil, display, display)
+	if err != nil {
+		return []byte("<code class=\"math-error\" title=\"" + html.EscapeString(err.Error()) + "\">" +
+			html.EscapeString(tex) + "</code>")
+	}
+
+	return mathMLPolicy.SanitizeBytes([]byte(converted))
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// metricsPath is the URL path Prometheus metrics are served on
+const metricsPath = "/metrics"
+
+// The blog's Prometheus metrics. Their names and labels are relied on by dashboards and alerts, so
+// must not change once released.
+var (
+	// bloggernetes_http_requests_total counts HTTP requests by route, such as "/post/", method and
+	// status code
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloggernetes_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// bloggernetes_http_request_duration_seconds observes how long HTTP requests take to answer by
+	// route and method
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bloggernetes_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// bloggernetes_template_render_duration_seconds observes how long templates take to execute, by
+	// template name such as "post". Pages served from the render cache are not observed.
+	templateRenderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bloggernetes_template_render_duration_seconds",
+		Help:    "Time taken to execute templates by template name.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"template"})
+
+	// bloggernetes_controller_events_total counts the informer events handled by the controller, by
+	// resource, such as "blogposts", and event type: add, update or delete
+	controllerEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloggernetes_controller_events_total",
+		Help: "Informer events handled by the controller by resource and event type.",
+	}, []string{"resource", "type"})
+
+	// bloggernetes_controller_conversion_failures_total counts resources that could not be
+	// converted into posts or pages, by resource
+	controllerConversionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloggernetes_controller_conversion_failures_total",
+		Help: "Resources that failed to convert to posts or pages by resource.",
+	}, []string{"resource"})
+
+	// bloggernetes_controller_retries_total counts reconciliations that failed and were queued to be
+	// retried, by resource
+	controllerRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloggernetes_controller_retries_total",
+		Help: "Failed reconciliations queued to be retried by resource.",
+	}, []string{"resource"})
+
+	// bloggernetes_informer_synced is 1 once an informer has listed its resources, by resource
+	informerSynced = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bloggernetes_informer_synced",
+		Help: "Whether the informer for a resource has synced its cache (1) or not (0).",
+	}, []string{"resource"})
+
+	// bloggernetes_informer_last_sync_timestamp_seconds is when an informer last synced or
+	// delivered an event, including its periodic resyncs, by resource
+	informerLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bloggernetes_informer_last_sync_timestamp_seconds",
+		Help: "Unix time the informer for a resource last synced or delivered an event.",
+	}, []string{"resource"})
+
+	// bloggernetes_git_syncs_total counts pulls of the git repository by result: success or failure
+	gitSyncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bloggernetes_git_syncs_total",
+		Help: "Pulls of the git repository by result.",
+	}, []string{"result"})
+
+	// bloggernetes_git_last_sync_timestamp_seconds is when the git repository was last pulled
+	// successfully
+	gitLastSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bloggernetes_git_last_sync_timestamp_seconds",
+		Help: "Unix time the git repository was last pulled successfully.",
+	})
+
+	// bloggernetes_leader is 1 while this replica may write to the cluster, which it always may
+	// when leader election is disabled
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bloggernetes_leader",
+		Help: "Whether this replica is the leader that writes statuses (1) or not (0).",
+	})
+)
+
+// bloggernetes_store_size is the number of posts, pages, tags, authors and assets in the store, by kind
+var storeSizeDesc = prometheus.NewDesc(
+	"bloggernetes_store_size",
+	"Number of objects in the store by kind: posts, pages, tags, authors or assets.",
+	[]string{"kind"}, nil,
+)
+
+// storeCollector reports the size of the store when metrics are scraped
+type storeCollector struct {
+	store *Store
+}
+
+// Describe implements prometheus.Collector
+func (c storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeSizeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	sizes := map[string]int{
+		"posts":   len(c.store.GetAllPosts()),
+		"pages":   len(c.store.GetAllPages()),
+		"tags":    len(c.store.GetAllTags()),
+		"authors": len(c.store.GetAllAuthors()),
+		"assets":  len(c.store.GetAllAssets()),
+	}
+	for kind, size := range sizes {
+		ch <- prometheus.MustNewConstMetric(storeSizeDesc, prometheus.GaugeValue, float64(size), kind)
+	}
+}
+
+// NewMetricsHandler creates a handler serving the blog's metrics, along with those of the Go
+// runtime and process, in the Prometheus exposition format
+func NewMetricsHandler(store *Store) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		templateRenderDuration,
+		controllerEventsTotal,
+		controllerConversionFailuresTotal,
+		controllerRetriesTotal,
+		informerSynced,
+		informerLastSync,
+		gitSyncsTotal,
+		gitLastSync,
+		leaderGauge,
+		storeCollector{store: store},
+	)
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// instrumentRoute wraps the handler of a route to count its requests and observe their durations,
+// and names the request's span after the route
+func instrumentRoute(route string, handler http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	traced := func(w http.ResponseWriter, r *http.Request) {
+		nameRequestSpan(r, route)
+		handler(w, r)
+	}
+	return promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequestsTotal.MustCurryWith(labels), http.HandlerFunc(traced)),
+	)
+}
+
+// recordEvent counts an informer event for a resource and records when it was delivered
+func recordEvent(resource schema.GroupVersionResource, eventType string) {
+	controllerEventsTotal.WithLabelValues(resource.Resource, eventType).Inc()
+	informerLastSync.WithLabelValues(resource.Resource).Set(float64(time.Now().Unix()))
+}
+
+// recordConversionFailure counts a resource that could not be converted into a post or page
+func recordConversionFailure(resource schema.GroupVersionResource) {
+	controllerConversionFailuresTotal.WithLabelValues(resource.Resource).Inc()
+}
+
+// recordRetry counts a failed reconciliation of a resource that will be retried
+func recordRetry(resource schema.GroupVersionResource) {
+	controllerRetriesTotal.WithLabelValues(resource.Resource).Inc()
+}
+
+// recordSynced records whether the informer for a resource has synced its cache
+func recordSynced(resource schema.GroupVersionResource, synced bool) {
+	if !synced {
+		informerSynced.WithLabelValues(resource.Resource).Set(0)
+		return
+	}
+	informerSynced.WithLabelValues(resource.Resource).Set(1)
+	informerLastSync.WithLabelValues(resource.Resource).Set(float64(time.Now().Unix()))
+}
+
+// recordGitSync counts a pull of the git repository and records when it last succeeded
+func recordGitSync(err error) {
+	if err != nil {
+		gitSyncsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	gitSyncsTotal.WithLabelValues("success").Inc()
+	gitLastSync.Set(float64(time.Now().Unix()))
+}
+
+// recordLeader records whether this replica may write to the cluster
+func recordLeader(leader bool) {
+	if leader {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+}
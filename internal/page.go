@@ -1,26 +1,41 @@
 package internal
 
 import (
+	"html/template"
 	"sort"
+	"time"
 )
 
 // BlogPage represents a blog page from the Kubernetes CRD
 type BlogPage struct {
-	ID      string
-	Title   string
-	Content string
-	Order   int
+	ID           string
+	Title        string
+	Content      string
+	ContentHTML  template.HTML // Content rendered from Markdown
+	PlainText    string        // Prose of the content without markup, for excerpts
+	Order        int
+	HasMath      bool
+	HasMermaid   bool
+	RenderErrors []string // Problems found while rendering the content, such as unknown shortcodes
+
+	// Modified is when the page's resource or file last changed, or zero if unknown
+	Modified time.Time
 }
 
 // BlogPages is a slice of BlogPage that can be sorted by Order
 type BlogPages []*BlogPage
 
-// Implement sort.Interface for BlogPages
-func (b BlogPages) Len() int           { return len(b) }
-func (b BlogPages) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b BlogPages) Less(i, j int) bool { return b[i].Order < b[j].Order }
+// Implement sort.Interface for BlogPages, falling back to ID for equal orders
+func (b BlogPages) Len() int      { return len(b) }
+func (b BlogPages) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b BlogPages) Less(i, j int) bool {
+	if b[i].Order != b[j].Order {
+		return b[i].Order < b[j].Order
+	}
+	return b[i].ID < b[j].ID
+}
 
-// SortByOrder sorts the blog pages by Order in ascending order
+// SortByOrder sorts the blog pages by Order in ascending order, so that they are listed consistently
 func SortByOrder(pages []*BlogPage) {
 	sort.Sort(BlogPages(pages))
-}
\ No newline at end of file
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"html/template"
 	"sort"
 	"time"
 )
@@ -15,6 +16,19 @@ type BlogPost struct {
 	Tags            []string
 	AuthoredDate    time.Time
 	UpdatedDate     *time.Time
+	Series          string
+	SeriesOrder     int
+	BodyHTML        template.HTML // Body rendered from Markdown
+	TOC             []*TOCEntry   // Headings of the body, empty if the post opts out
+	PlainText       string        // Prose of the body without markup, for excerpts
+	WordCount       int
+	ReadingTime     int // Estimated reading time in minutes
+	HasMath         bool
+	HasMermaid      bool
+	RenderErrors    []string // Problems found while rendering the body, such as unknown shortcodes
+
+	// Modified is when the post's resource or file last changed, or zero if unknown
+	Modified time.Time
 }
 
 // BlogPosts is a slice of BlogPost that can be sorted by AuthoredDate
@@ -23,9 +37,93 @@ type BlogPosts []*BlogPost
 // Implement sort.Interface for BlogPosts
 func (b BlogPosts) Len() int           { return len(b) }
 func (b BlogPosts) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b BlogPosts) Less(i, j int) bool { return b[i].AuthoredDate.After(b[j].AuthoredDate) }
+func (b BlogPosts) Less(i, j int) bool { return isNewer(b[i], b[j]) }
+
+// isNewer reports whether a was authored after b, falling back to ID for posts authored at the same time
+func isNewer(a, b *BlogPost) bool {
+	if !a.AuthoredDate.Equal(b.AuthoredDate) {
+		return a.AuthoredDate.After(b.AuthoredDate)
+	}
+	return a.ID < b.ID
+}
 
 // SortByAuthoredDate sorts the blog posts by AuthoredDate in descending order (newest first)
 func SortByAuthoredDate(posts []*BlogPost) {
 	sort.Sort(BlogPosts(posts))
 }
+
+// RelatednessScore scores how closely other relates to post: two points for every shared tag
+// and one point for sharing an author. Unrelated posts score zero.
+func RelatednessScore(post, other *BlogPost) int {
+	score := 0
+	for _, tag := range post.Tags {
+		for _, otherTag := range other.Tags {
+			if tag == otherTag {
+				score += 2
+				break
+			}
+		}
+	}
+
+	if post.Author == other.Author {
+		score++
+	}
+
+	return score
+}
+
+// SeriesParts is a slice of BlogPost that can be sorted by SeriesOrder
+type SeriesParts []*BlogPost
+
+// Implement sort.Interface for SeriesParts, falling back to AuthoredDate (oldest first) and then ID
+// for equal orders, so that the parts are listed the same way on every request
+func (s SeriesParts) Len() int      { return len(s) }
+func (s SeriesParts) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SeriesParts) Less(i, j int) bool {
+	if s[i].SeriesOrder != s[j].SeriesOrder {
+		return s[i].SeriesOrder < s[j].SeriesOrder
+	}
+	if !s[i].AuthoredDate.Equal(s[j].AuthoredDate) {
+		return s[i].AuthoredDate.Before(s[j].AuthoredDate)
+	}
+	return s[i].ID < s[j].ID
+}
+
+// SortBySeriesOrder sorts the blog posts by SeriesOrder in ascending order
+func SortBySeriesOrder(posts []*BlogPost) {
+	sort.Sort(SeriesParts(posts))
+}
+
+// SeriesNavigation describes where a post sits within its series
+type SeriesNavigation struct {
+	Name     string
+	Parts    []*BlogPost
+	Position int // 1-based position of the current post within Parts
+	Previous *BlogPost
+	Next     *BlogPost
+}
+
+// NewSeriesNavigation builds the navigation for a post from the ordered parts of its series
+func NewSeriesNavigation(post *BlogPost, parts []*BlogPost) *SeriesNavigation {
+	nav := &SeriesNavigation{
+		Name:  post.Series,
+		Parts: parts,
+	}
+
+	for i, part := range parts {
+		if part.ID != post.ID {
+			continue
+		}
+
+		nav.Position = i + 1
+		if i > 0 {
+			nav.Previous = parts[i-1]
+		}
+		if i < len(parts)-1 {
+			nav.Next = parts[i+1]
+		}
+		break
+	}
+
+	return nav
+}
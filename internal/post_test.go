@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSortBySeriesOrderBreaksTies(t *testing.T) {
+	authored := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, posts := range [][]*BlogPost{
+		{{ID: "part-b", SeriesOrder: 1, AuthoredDate: authored}, {ID: "part-a", SeriesOrder: 1, AuthoredDate: authored}},
+		{{ID: "part-a", SeriesOrder: 1, AuthoredDate: authored}, {ID: "part-b", SeriesOrder: 1, AuthoredDate: authored}},
+	} {
+		SortBySeriesOrder(posts)
+		if posts[0].ID != "part-a" || posts[1].ID != "part-b" {
+			t.Errorf("expected parts with the same order and date to be sorted by ID, got %s then %s", posts[0].ID, posts[1].ID)
+		}
+	}
+
+	// The order and date still come first
+	posts := []*BlogPost{
+		{ID: "a", SeriesOrder: 2, AuthoredDate: authored},
+		{ID: "b", SeriesOrder: 1, AuthoredDate: authored.Add(time.Hour)},
+		{ID: "c", SeriesOrder: 1, AuthoredDate: authored},
+	}
+	SortBySeriesOrder(posts)
+	if posts[0].ID != "c" || posts[1].ID != "b" || posts[2].ID != "a" {
+		t.Errorf("expected parts sorted by order then date, got %s, %s, %s", posts[0].ID, posts[1].ID, posts[2].ID)
+	}
+}
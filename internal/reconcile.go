@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// reconcileWorkers is the number of resources reconciled at once. Each key is only ever reconciled
+// by one worker at a time.
+const reconcileWorkers = 4
+
+// reconcileKey identifies a resource to reconcile by its kind and namespace/name key
+type reconcileKey struct {
+	resource schema.GroupVersionResource
+	key      string
+}
+
+// invalidSpecError is a conversion failure caused by a resource's spec, which retrying cannot fix
+// until the resource is changed
+type invalidSpecError struct {
+	err error
+}
+
+func (e invalidSpecError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidSpecError) Unwrap() error {
+	return e.err
+}
+
+// invalidSpec returns an error reporting a problem with a resource's spec
+func invalidSpec(format string, args ...interface{}) error {
+	return invalidSpecError{err: fmt.Errorf(format, args...)}
+}
+
+// newReconcileQueue creates the queue of resources to reconcile, which retries failures with
+// exponential backoff
+func newReconcileQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewRateLimitingQueueWithConfig(
+		workqueue.DefaultControllerRateLimiter(),
+		workqueue.RateLimitingQueueConfig{Name: "bloggernetes"},
+	)
+}
+
+// eventHandler returns the informer event handler for a resource, which counts each event and
+// queues the resource to be reconciled
+func (c *Controller) eventHandler(resource schema.GroupVersionResource) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			recordEvent(resource, "add")
+			c.enqueue(resource, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			recordEvent(resource, "update")
+			c.enqueue(resource, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			recordEvent(resource, "delete")
+			c.enqueue(resource, obj)
+		},
+	}
+}
+
+// enqueue queues a resource to be reconciled. Deleted resources may be delivered as tombstones
+// when the deletion was missed while the watch was down, which still carry their key.
+func (c *Controller) enqueue(resource schema.GroupVersionResource, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Error("Failed to get key of resource", "resource", resource.Resource, "error", err)
+		return
+	}
+	c.queue.Add(reconcileKey{resource: resource, key: key})
+}
+
+// enqueueAll queues every resource in the informers' caches to be reconciled
+func (c *Controller) enqueueAll() {
+	for resource, informer := range c.informers {
+		for _, key := range informer.GetStore().ListKeys() {
+			c.queue.Add(reconcileKey{resource: resource, key: key})
+		}
+	}
+}
+
+// runWorkers reconciles queued resources until the queue is shut down
+func (c *Controller) runWorkers() {
+	var workers sync.WaitGroup
+	for i := 0; i < reconcileWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for c.processNextItem() {
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// processNextItem reconciles the next queued resource, returning false once the queue is shut down
+func (c *Controller) processNextItem() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(reconcileKey)
+	err := c.reconcile(key)
+	c.initialSync.done(key)
+
+	var specErr invalidSpecError
+	switch {
+	case err == nil:
+		c.queue.Forget(item)
+	case errors.As(err, &specErr):
+		// Reported through the resource's status; it is reconciled again once it changes
+		c.queue.Forget(item)
+	default:
+		log.Error("Failed to reconcile, retrying", "resource", key.resource.Resource, "key", key.key,
+			"attempts", c.queue.NumRequeues(item)+1, "error", err)
+		recordRetry(key.resource)
+		c.queue.AddRateLimited(item)
+	}
+	return true
+}
+
+// reconcile brings the store, and the status of the resource if this replica is the leader, up to
+// date with the resource in the informer's cache
+func (c *Controller) reconcile(key reconcileKey) error {
+	informer, ok := c.informers[key.resource]
+	if !ok {
+		return invalidSpec("unknown resource %s", key.resource.Resource)
+	}
+
+	obj, exists, err := informer.GetIndexer().GetByKey(key.key)
+	if err != nil {
+		return fmt.Errorf("failed to get %s %s from cache: %w", key.resource.Resource, key.key, err)
+	}
+	if !exists {
+		c.remove(key)
+		return nil
+	}
+
+	switch key.resource {
+	case BlogPostResource:
+		return c.reconcilePost(key, obj)
+	case BlogPageResource:
+		return c.reconcilePage(key, obj)
+	case BlogAssetResource:
+		return c.reconcileAsset(key, obj)
+	default:
+		return invalidSpec("unknown resource %s", key.resource.Resource)
+	}
+}
+
+// reconcilePost converts a BlogPost and adds it to the store
+func (c *Controller) reconcilePost(key reconcileKey, obj interface{}) error {
+	post, err := convertToBlogPost(obj, c.renderer, c.readContent)
+	if err != nil {
+		log.Error("Failed to convert BlogPost", "key", key.key, "error", err)
+		recordConversionFailure(BlogPostResource)
+		if statusErr := c.recordRendered(BlogPostResource, obj, err, nil); statusErr != nil {
+			// Retry reporting the failure, even though the spec itself needs fixing
+			return fmt.Errorf("failed to report conversion failure: %w", statusErr)
+		}
+		return err
+	}
+
+	owner := clusterOwner(key, obj)
+	previousID, existed := c.track(key, post.ID)
+	if existed && previousID != post.ID {
+		// The post's ID changed, so it moves to a new URL
+		c.store.DeletePost(owner, previousID)
+	}
+	changed, err := c.store.AddOrUpdatePost(owner, post)
+	if err != nil {
+		// Another resource or file with the same ID is served until it is deleted
+		log.Error("Failed to add BlogPost", "key", key.key, "error", err)
+		if statusErr := c.recordRendered(BlogPostResource, obj, err, nil); statusErr != nil {
+			return fmt.Errorf("failed to report conflict: %w", statusErr)
+		}
+		return err
+	}
+	if changed && existed {
+		log.Info("BlogPost updated", "id", post.ID, "title", post.Title)
+	} else if changed {
+		log.Info("BlogPost added", "id", post.ID, "title", post.Title)
+	}
+
+	return c.recordRendered(BlogPostResource, obj, nil, post.RenderErrors)
+}
+
+// reconcilePage converts a BlogPage and adds it to the store
+func (c *Controller) reconcilePage(key reconcileKey, obj interface{}) error {
+	page, err := convertToBlogPage(obj, c.renderer, c.readContent)
+	if err != nil {
+		log.Error("Failed to convert BlogPage", "key", key.key, "error", err)
+		recordConversionFailure(BlogPageResource)
+		if statusErr := c.recordRendered(BlogPageResource, obj, err, nil); statusErr != nil {
+			return fmt.Errorf("failed to report conversion failure: %w", statusErr)
+		}
+		return err
+	}
+
+	owner := clusterOwner(key, obj)
+	previousID, existed := c.track(key, page.ID)
+	if existed && previousID != page.ID {
+		c.store.DeletePage(owner, previousID)
+	}
+	changed, err := c.store.AddOrUpdatePage(owner, page)
+	if err != nil {
+		log.Error("Failed to add BlogPage", "key", key.key, "error", err)
+		if statusErr := c.recordRendered(BlogPageResource, obj, err, nil); statusErr != nil {
+			return fmt.Errorf("failed to report conflict: %w", statusErr)
+		}
+		return err
+	}
+	if changed && existed {
+		log.Info("BlogPage updated", "id", page.ID, "title", page.Title)
+	} else if changed {
+		log.Info("BlogPage added", "id", page.ID, "title", page.Title)
+	}
+
+	return c.recordRendered(BlogPageResource, obj, nil, page.RenderErrors)
+}
+
+// reconcileAsset converts a BlogAsset and adds it to the store
+func (c *Controller) reconcileAsset(key reconcileKey, obj interface{}) error {
+	asset, err := convertToBlogAsset(obj, c.readContent)
+	if err != nil {
+		log.Error("Failed to convert BlogAsset", "key", key.key, "error", err)
+		recordConversionFailure(BlogAssetResource)
+		if statusErr := c.recordLoaded(obj, err); statusErr != nil {
+			return fmt.Errorf("failed to report conversion failure: %w", statusErr)
+		}
+		return err
+	}
+
+	owner := clusterOwner(key, obj)
+	previousName, existed := c.track(key, asset.Name)
+	if existed && previousName != asset.Name {
+		c.store.DeleteAsset(owner, previousName)
+	}
+	changed, err := c.store.AddOrUpdateAsset(owner, asset)
+	if err != nil {
+		log.Error("Failed to add BlogAsset", "key", key.key, "error", err)
+		if statusErr := c.recordLoaded(obj, err); statusErr != nil {
+			return fmt.Errorf("failed to report conflict: %w", statusErr)
+		}
+		return err
+	}
+	if changed && existed {
+		log.Info("BlogAsset updated", "name", asset.Name, "bytes", len(asset.Content))
+	} else if changed {
+		log.Info("BlogAsset added", "name", asset.Name, "bytes", len(asset.Content))
+	}
+
+	return c.recordLoaded(obj, nil)
+}
+
+// remove removes a deleted resource from the store
+func (c *Controller) remove(key reconcileKey) {
+	id, existed := c.untrack(key)
+	if !existed {
+		return
+	}
+
+	owner := clusterOwner(key, nil)
+	switch key.resource {
+	case BlogPostResource:
+		log.Info("BlogPost deleted", "id", id)
+		c.store.DeletePost(owner, id)
+	case BlogPageResource:
+		log.Info("BlogPage deleted", "id", id)
+		c.store.DeletePage(owner, id)
+	case BlogAssetResource:
+		log.Info("BlogAsset deleted", "name", id)
+		c.store.DeleteAsset(owner, id)
+	}
+}
+
+// clusterOwner returns the owner in the store of what a resource defines. The oldest resource's
+// claim to an ID wins, so the resource is needed for when it was created unless it was deleted.
+func clusterOwner(key reconcileKey, obj interface{}) ContentOwner {
+	owner := ContentOwner{Source: SourceCluster, Resource: key.resource, Key: key.key}
+	if unstructuredObj, ok := obj.(*unstructured.Unstructured); ok {
+		owner.Created = unstructuredObj.GetCreationTimestamp().Time
+	}
+	return owner
+}
+
+// track records the ID in the store of the resource with a key, returning the ID it had before
+func (c *Controller) track(key reconcileKey, id string) (string, bool) {
+	c.idsMu.Lock()
+	defer c.idsMu.Unlock()
+
+	previous, existed := c.ids[key]
+	c.ids[key] = id
+	return previous, existed
+}
+
+// untrack forgets the ID in the store of a deleted resource, returning the ID it had
+func (c *Controller) untrack(key reconcileKey) (string, bool) {
+	c.idsMu.Lock()
+	defer c.idsMu.Unlock()
+
+	id, existed := c.ids[key]
+	delete(c.ids, key)
+	return id, existed
+}
+
+// initialSync tracks the resources listed when the informers first synced, so that the controller
+// only reports itself synced once each has been reconciled, successfully or not
+type initialSync struct {
+	mu      sync.Mutex
+	pending map[reconcileKey]struct{}
+	synced  chan struct{}
+}
+
+// begin starts waiting for the listed resources to be reconciled, and returns the channel closed
+// once they have been
+func (s *initialSync) begin(keys []reconcileKey) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.synced = make(chan struct{})
+	s.pending = make(map[reconcileKey]struct{}, len(keys))
+	for _, key := range keys {
+		s.pending[key] = struct{}{}
+	}
+	if len(s.pending) == 0 {
+		close(s.synced)
+	}
+	return s.synced
+}
+
+// done records that a resource has been reconciled
+func (s *initialSync) done(key reconcileKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return
+	}
+	if _, isPending := s.pending[key]; !isPending {
+		return
+	}
+	delete(s.pending, key)
+	if len(s.pending) == 0 {
+		close(s.synced)
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"bytes"
+	"sync"
+)
+
+// DefaultRenderCacheSize is the number of rendered pages kept when none is configured
+const DefaultRenderCacheSize = 1000
+
+// bufferPool holds buffers for rendering templates into, so that each request does not grow a new one
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// renderedPage is the output of a page template
+type renderedPage struct {
+	Content []byte
+	ETag    string // Empty for error pages, which are not validated
+}
+
+// renderVersion identifies the content and templates a page was rendered from
+type renderVersion struct {
+	storeRevision   uint64
+	themeGeneration uint64
+}
+
+// renderCache holds rendered pages until the posts, pages or theme change, so that unchanged pages
+// are served without executing their templates again. Pages are rendered with a placeholder in
+// place of the script nonce, which is replaced by each response's own nonce when served.
+type renderCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	version    renderVersion
+	pages      map[string]*renderedPage // Indexed by template name and URL path
+}
+
+// newRenderCache creates a render cache holding up to maxEntries pages, or nil if maxEntries is not
+// positive, which disables caching
+func newRenderCache(maxEntries int) *renderCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &renderCache{
+		maxEntries: maxEntries,
+		pages:      make(map[string]*renderedPage),
+	}
+}
+
+// get returns the page cached under key, if it was rendered from the given version
+func (c *renderCache) get(key string, version renderVersion) (*renderedPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version != version {
+		return nil, false
+	}
+	page, exists := c.pages[key]
+	return page, exists
+}
+
+// put caches a page rendered from the given version, discarding pages rendered from other versions.
+// Once the cache is full, further pages are not cached until the version changes.
+func (c *renderCache) put(key string, version renderVersion, page *renderedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version != version {
+		// A page rendered before the latest change is already out of date
+		if version.storeRevision < c.version.storeRevision || version.themeGeneration < c.version.themeGeneration {
+			return
+		}
+		c.version = version
+		c.pages = make(map[string]*renderedPage)
+	}
+	if len(c.pages) >= c.maxEntries {
+		return
+	}
+	c.pages[key] = page
+}
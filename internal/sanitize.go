@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// HTML policies decide how much of the HTML written by authors reaches readers
+const (
+	// HTMLPolicyTrusted passes raw HTML through untouched, for blogs where every author is trusted
+	HTMLPolicyTrusted = "trusted"
+	// HTMLPolicySanitized allows raw HTML, but removes anything outside an allow-list of safe tags,
+	// attributes and URL schemes
+	HTMLPolicySanitized = "sanitized"
+	// HTMLPolicyStrict omits raw HTML entirely, and sanitizes what remains
+	HTMLPolicyStrict = "strict"
+)
+
+// DefaultHTMLPolicy is the HTML policy used when none is configured
+const DefaultHTMLPolicy = HTMLPolicySanitized
+
+// HTMLPolicies returns the names of the available HTML policies
+func HTMLPolicies() []string {
+	return []string{HTMLPolicyStrict, HTMLPolicySanitized, HTMLPolicyTrusted}
+}
+
+// externalLinkRel is added to links that leave the blog, so the destination can neither reach
+// back into the page nor gain search ranking from it
+const externalLinkRel = "noopener nofollow"
+
+// sanitizationKey is the document metadata key holding the sanitization state of a render
+const sanitizationKey = "bloggernetes.sanitization"
+
+// generatedPlaceholder matches the placeholders left in place of generated HTML during sanitization
+var generatedPlaceholder = regexp.MustCompile(`bloggernetes-generated-([0-9a-f]{32})-([0-9]+)`)
+
+// srcSetPattern matches srcset attributes of one or more candidates, each an http, https or
+// site-relative URL with an optional width or density descriptor
+var srcSetPattern = regexp.MustCompile(`^\s*(https?://|/)[^\s,]+(\s+[0-9.]+[wx])?\s*(,\s*(https?://|/)[^\s,]+(\s+[0-9.]+[wx])?\s*)*$`)
+
+// newSanitizerPolicy builds the allow-list applied to rendered author content. HTML generated by
+// the renderer itself, such as highlighted code, math and shortcodes, is not subject to it.
+func newSanitizerPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+
+	// Only http, https and mailto URLs, or relative URLs, are kept
+	policy.AllowURLSchemes("http", "https", "mailto")
+	policy.RequireNoFollowOnLinks(false)
+	policy.RequireNoFollowOnFullyQualifiedLinks(true)
+	policy.AllowAttrs("rel").Matching(regexp.MustCompile(`^(noopener|noreferrer|nofollow| )+$`)).OnElements("a")
+	// Links opening a new window are given rel="noopener" by the sanitizer
+	policy.AllowAttrs("target").Matching(regexp.MustCompile(`^_blank$`)).OnElements("a")
+
+	// GitHub Flavored Markdown task lists and table alignment
+	policy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").OnElements("input")
+	policy.AllowStyles("text-align").MatchingEnum("left", "center", "right").OnElements("th", "td")
+
+	// Resized variants of images served as BlogAssets, whose candidate URLs are held to the same
+	// schemes as other URLs
+	policy.AllowAttrs("srcset").Matching(srcSetPattern).OnElements("img")
+	policy.AllowAttrs("sizes").Matching(regexp.MustCompile(`^[\w\s(),.:%-]+$`)).OnElements("img")
+
+	return policy
+}
+
+// sanitization tracks the HTML generated by the renderer during a single render. Generated HTML is
+// swapped for unguessable placeholders while the document is sanitized, then restored.
+type sanitization struct {
+	policy    *bluemonday.Policy
+	token     string
+	generated [][]byte
+}
+
+// newSanitization creates the sanitization state for a render using the given policy
+func newSanitization(policy *bluemonday.Policy) (*sanitization, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate placeholder token: %w", err)
+	}
+
+	return &sanitization{policy: policy, token: hex.EncodeToString(token)}, nil
+}
+
+// sanitize applies the policy to rendered HTML, keeping any generated HTML it contains
+func (s *sanitization) sanitize(rendered []byte) []byte {
+	return s.policy.SanitizeBytes(rendered)
+}
+
+// restore replaces the placeholders in sanitized HTML with the generated HTML they stand for
+func (s *sanitization) restore(sanitized []byte) []byte {
+	return generatedPlaceholder.ReplaceAllFunc(sanitized, func(placeholder []byte) []byte {
+		match := generatedPlaceholder.FindSubmatch(placeholder)
+		index, err := strconv.Atoi(string(match[2]))
+		if string(match[1]) != s.token || err != nil || index >= len(s.generated) {
+			return nil
+		}
+
+		// Generated HTML may itself hold placeholders, such as a shortcode containing math
+		return s.restore(s.generated[index])
+	})
+}
+
+// sanitizationOf returns the sanitization state of the document a node belongs to, or nil if
+// the document is not being sanitized
+func sanitizationOf(node ast.Node) *sanitization {
+	doc := node.OwnerDocument()
+	if doc == nil {
+		return nil
+	}
+
+	s, _ := doc.Meta()[sanitizationKey].(*sanitization)
+	return s
+}
+
+// writeGenerated writes HTML generated by the renderer itself for a node, which is trusted and
+// so must not be altered by sanitization
+func writeGenerated(w util.BufWriter, node ast.Node, generated []byte) {
+	s := sanitizationOf(node)
+	if s == nil {
+		w.Write(generated)
+		return
+	}
+
+	fmt.Fprintf(w, "bloggernetes-generated-%s-%d", s.token, len(s.generated))
+	s.generated = append(s.generated, generated)
+}
+
+// sanitizeFragment sanitizes rendered author content that is embedded within generated HTML, such
+// as the Markdown inside a shortcode
+func sanitizeFragment(node ast.Node, rendered []byte) []byte {
+	if s := sanitizationOf(node); s != nil {
+		return s.sanitize(rendered)
+	}
+	return rendered
+}
+
+// externalLinkTransformer marks links to other sites with externalLinkRel
+type externalLinkTransformer struct{}
+
+// Transform implements parser.ASTTransformer
+func (t *externalLinkTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n := node.(type) {
+		case *ast.Link:
+			if isExternalURL(n.Destination) {
+				n.SetAttributeString("rel", []byte(externalLinkRel))
+			}
+		case *ast.AutoLink:
+			if n.AutoLinkType == ast.AutoLinkURL && isExternalURL(n.URL(source)) {
+				n.SetAttributeString("rel", []byte(externalLinkRel))
+			}
+		}
+
+		return ast.WalkContinue, nil
+	})
+}
+
+// isExternalURL reports whether a link destination points to another site
+func isExternalURL(destination []byte) bool {
+	if bytes.HasPrefix(destination, []byte("//")) {
+		return true
+	}
+
+	parsed, err := url.Parse(string(destination))
+	return err == nil && parsed.Host != ""
+}
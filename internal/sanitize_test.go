@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderRemovesPayloads(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		markdown  string
+		forbidden []string
+	}{
+		{
+			name:      "script tag",
+			markdown:  "Hello <script>alert(1)</script>",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "script tag under strict",
+			policy:    HTMLPolicyStrict,
+			markdown:  "<script>alert(1)</script>\n\nHello",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "onerror handler",
+			markdown:  `<img src=x onerror=alert(1)>`,
+			forbidden: []string{"onerror"},
+		},
+		{
+			name:      "style attribute",
+			markdown:  `<p style="background:url(javascript:alert(1))">Hello</p>`,
+			forbidden: []string{"style=", "javascript:"},
+		},
+		{
+			name:      "javascript link",
+			markdown:  "[click](javascript:alert(1))",
+			forbidden: []string{"javascript:"},
+		},
+		{
+			name:      "javascript link in raw HTML",
+			markdown:  `<a href="JaVaScRiPt:alert(1)">click</a>`,
+			forbidden: []string{"javascript:", "JaVaScRiPt:"},
+		},
+		{
+			name:      "javascript srcset",
+			markdown:  `<img src="/a.png" srcset="javascript:alert(1) 1x">`,
+			forbidden: []string{"javascript:"},
+		},
+		{
+			name:      "backtick and template literal in shortcode parameters",
+			markdown:  "{{< gist user=\"a`;alert(1);`\" id=\"${alert(1)}\" >}}",
+			forbidden: []string{"`", "${"},
+		},
+		{
+			name:      "attribute breakout in shortcode parameters",
+			markdown:  `{{< youtube id="x\" onload=\"alert(1)" title="\"><script>alert(1)</script>" >}}`,
+			forbidden: []string{` onload=`, "<script"},
+		},
+		{
+			name:      "javascript URL in shortcode parameters",
+			markdown:  `{{< figure src="javascript:alert(1)" caption="<img src=x onerror=alert(1)>" >}}`,
+			forbidden: []string{"javascript:", "<img src=x"},
+		},
+		{
+			name:      "raw HTML inside a shortcode",
+			markdown:  "{{< callout >}}\n<script>alert(1)</script>\n{{< /callout >}}",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "mermaid diagram",
+			markdown:  "```mermaid\n</pre><script>alert(1)</script>\n```",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "inline math text",
+			markdown:  `$\text{<img src=x onerror=alert(1)>}$`,
+			forbidden: []string{"<img"},
+		},
+		{
+			name:      "display math text",
+			markdown:  "$$\n\\text{<script>alert(1)</script>}\n$$",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "math text under trusted",
+			policy:    HTMLPolicyTrusted,
+			markdown:  "$$\n\\text{<script>alert(1)</script>}\n$$",
+			forbidden: []string{"<script"},
+		},
+		{
+			name:      "math class breakout",
+			markdown:  `$\class{x" onclick="alert(1)}{y}$`,
+			forbidden: []string{`onclick="`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := render(t, test.policy, test.markdown)
+			for _, forbidden := range test.forbidden {
+				if strings.Contains(output, forbidden) {
+					t.Errorf("output contains %q:\n%s", forbidden, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderKeepsContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		markdown string
+		want     []string
+	}{
+		{
+			name:     "formatting",
+			markdown: "Some <em>emphasis</em> and a [link](/post/other)",
+			want:     []string{"<em>emphasis</em>", `<a href="/post/other">link</a>`},
+		},
+		{
+			name:     "external link",
+			markdown: "[elsewhere](https://example.com)",
+			want:     []string{`rel="noopener nofollow"`},
+		},
+		{
+			name:     "external link in raw HTML",
+			markdown: `<a href="https://example.com" target="_blank">elsewhere</a>`,
+			want:     []string{"nofollow", "noopener"},
+		},
+		{
+			name:     "math",
+			markdown: `$\frac{a}{b} + \text{where } \overbrace{x}$`,
+			want:     []string{"<mfrac>", "<mi>a</mi>", "<mtext>where", "⏞"},
+		},
+		{
+			name:     "shortcode",
+			markdown: `{{< youtube id="dQw4w9WgXcQ" >}}`,
+			want:     []string{`src="https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ"`},
+		},
+		{
+			name:     "raw HTML under trusted",
+			policy:   HTMLPolicyTrusted,
+			markdown: `<div onclick="go()">Hello</div>`,
+			want:     []string{`onclick="go()"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := render(t, test.policy, test.markdown)
+			for _, want := range test.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("output does not contain %q:\n%s", want, output)
+				}
+			}
+		})
+	}
+}
+
+// render renders Markdown with the built-in shortcodes under the given HTML policy, or the
+// default policy if it is empty
+func render(t *testing.T, policy, markdown string) string {
+	t.Helper()
+
+	if policy == "" {
+		policy = DefaultHTMLPolicy
+	}
+
+	renderer, err := NewRenderer(DefaultShortcodes(), policy, ImageOptions{})
+	if err != nil {
+		t.Fatalf("failed to create renderer: %v", err)
+	}
+
+	rendered, err := renderer.Render(markdown)
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+
+	return string(rendered.HTML)
+}
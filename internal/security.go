@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// cspNoncePlaceholder is replaced in the Content-Security-Policy by the nonce generated for each
+// response, which templates attach to their inline scripts
+const cspNoncePlaceholder = "{nonce}"
+
+// DefaultContentSecurityPolicy allows the blog's own resources, including the bundled mermaid
+// script, and the sites that shortcodes embed. Styles are allowed inline because mermaid injects
+// them when drawing diagrams, and MathML and tables carry style attributes.
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-" + cspNoncePlaceholder + "' https://gist.github.com; " +
+	"style-src 'self' 'unsafe-inline' https://github.githubassets.com; " +
+	"img-src 'self' https: data:; " +
+	"frame-src https://www.youtube-nocookie.com; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// DefaultHSTSMaxAge is how long browsers are told to only use HTTPS for the blog
+const DefaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// DefaultReferrerPolicy sends only the origin to other sites
+const DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+
+// DefaultPermissionsPolicy denies the powerful browser features a blog has no need for
+const DefaultPermissionsPolicy = "camera=(), geolocation=(), microphone=(), payment=(), usb=()"
+
+// SecurityOptions configures the security headers sent with every response. Empty values and a
+// zero HSTSMaxAge disable the corresponding header.
+type SecurityOptions struct {
+	ContentSecurityPolicy string        // May contain {nonce}, replaced by each response's script nonce
+	HSTSMaxAge            time.Duration // Only sent on requests made over HTTPS
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+}
+
+// DefaultSecurityOptions returns the security headers used when none are configured
+func DefaultSecurityOptions() SecurityOptions {
+	return SecurityOptions{
+		ContentSecurityPolicy: DefaultContentSecurityPolicy,
+		HSTSMaxAge:            DefaultHSTSMaxAge,
+		ReferrerPolicy:        DefaultReferrerPolicy,
+		PermissionsPolicy:     DefaultPermissionsPolicy,
+	}
+}
+
+// middleware wraps an HTTP handler with additional behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain wraps a handler in middlewares, with the first middleware outermost
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// nonceKey is the request context key holding the response's script nonce
+type nonceKey struct{}
+
+// nonceFrom returns the script nonce generated for a request, or an empty string if there is none
+func nonceFrom(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+// newNonce generates a random nonce for use in a Content-Security-Policy
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// securityHeaders returns a middleware setting the configured security headers on every response
+func securityHeaders(options SecurityOptions) middleware {
+	usesNonce := strings.Contains(options.ContentSecurityPolicy, cspNoncePlaceholder)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			header.Set("X-Content-Type-Options", "nosniff")
+
+			if options.ContentSecurityPolicy != "" {
+				policy := options.ContentSecurityPolicy
+				if usesNonce {
+					nonce, err := newNonce()
+					if err != nil {
+						log.Error("Failed to generate nonce", "error", err)
+						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+						return
+					}
+					policy = strings.ReplaceAll(policy, cspNoncePlaceholder, nonce)
+					r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+				}
+				header.Set("Content-Security-Policy", policy)
+			}
+
+			if options.HSTSMaxAge > 0 && isHTTPS(r) {
+				header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(options.HSTSMaxAge.Seconds())))
+			}
+
+			if options.ReferrerPolicy != "" {
+				header.Set("Referrer-Policy", options.ReferrerPolicy)
+			}
+
+			if options.PermissionsPolicy != "" {
+				header.Set("Permissions-Policy", options.PermissionsPolicy)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isHTTPS reports whether a request reached the blog over HTTPS, either directly or through a
+// TLS-terminating proxy or ingress
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
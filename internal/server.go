@@ -1,16 +1,24 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"embed"
 	"encoding/xml"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/goodsign/monday"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // Templates contains the embedded HTML templates
@@ -35,7 +43,7 @@ type RSSChannel struct {
 	Link          string    `xml:"link"`
 	Description   string    `xml:"description"`
 	Language      string    `xml:"language"`
-	LastBuildDate string    `xml:"lastBuildDate"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
 	Generator     string    `xml:"generator"`
 	Items         []RSSItem `xml:"item"`
 }
@@ -46,92 +54,392 @@ type RSS struct {
 	Channel RSSChannel `xml:"channel"`
 }
 
+// DefaultShutdownTimeout is how long requests in progress are given to finish on shutdown, which
+// leaves time to spare within the 30 second grace period Kubernetes gives pods by default
+const DefaultShutdownTimeout = 20 * time.Second
+
+// ServerOptions configures the HTTP server
+type ServerOptions struct {
+	Addr       string
+	BlogName   string
+	CodeStyle  string // Colour scheme for highlighted code, one of CodeStyles
+	MermaidURL string // URL of the mermaid script used to draw diagrams, or empty to serve the bundled one
+	Mermaid    bool   // Whether diagrams are drawn, which requires a URL or a bundled mermaid script
+	Locale     string // Locale dates are written in, one of Locales
+	Timezone   string // IANA name of the timezone dates are written in, such as Europe/London
+	Security   SecurityOptions
+
+	// AdminAddr is the address to serve metrics and probes on, or empty to serve them on Addr
+	AdminAddr string
+
+	// Ready reports why the blog is not ready to serve, or nil when it is, for the readiness probe
+	Ready func() error
+
+	// Leader reports whether this replica leads the others, for the readiness probe to show, or is
+	// nil if replicas do not elect a leader
+	Leader func() bool
+
+	// GitWebhook is notified of pushes to the git repository content is read from, or nil if there
+	// is none
+	GitWebhook http.Handler
+
+	// CompressionMinSize is the size in bytes below which responses are sent uncompressed
+	CompressionMinSize int
+
+	// RenderCacheSize is the number of rendered pages kept until the posts, pages or theme change, or
+	// 0 to render every request
+	RenderCacheSize int
+
+	// ImageCacheSize is the number of bytes of resized images kept, or 0 to resize every request
+	ImageCacheSize int64
+
+	// ShutdownTimeout is how long requests in progress are given to finish when the server stops
+	ShutdownTimeout time.Duration
+}
+
 // Server is the HTTP server for the blog
 type Server struct {
-	store      *Store
-	templates  map[string]*template.Template
-	Addr       string
-	blogName   string
-	httpServer *http.Server
+	store          *Store
+	renderer       *Renderer
+	Addr           string
+	blogName       string
+	highlightStyle []byte
+	mermaidURL     string
+	mermaid        bool // Whether diagrams are drawn
+	locale         monday.Locale
+	timezone       *time.Location
+	security       SecurityOptions
+	httpServer     *http.Server
+	listener       net.Listener
+	adminAddr      string
+	adminServer    *http.Server
+	adminListener  net.Listener
+	metrics        http.Handler
+	ready          func() error
+	leader         func() bool
+	gitWebhook     http.Handler
+	stopping       atomic.Bool // Set once the server starts shutting down
+
+	shutdownTimeout time.Duration
+
+	compressionMinSize int
+
+	// The templates and assets of the current theme, which may be replaced while serving
+	mu              sync.RWMutex
+	templates       map[string]*template.Template
+	assets          *assets
+	themeGeneration uint64 // Incremented each time the theme is replaced
+
+	// Rendered pages, which hold noncePlaceholder in place of each response's script nonce
+	cache            *renderCache
+	noncePlaceholder string
+
+	// Resized variants of images served as BlogAssets, at the widths the renderer offers
+	images *imageCache
+}
+
+// pageTemplates are the templates rendered within the layout, indexed by name
+var pageTemplates = map[string]string{
+	"home":   "home.html",
+	"tag":    "tag.html",
+	"author": "author.html",
+	"post":   "post.html",
+	"page":   "page.html",
+	"series": "series.html",
+	"404":    "404.html",
+	"410":    "410.html",
+	"500":    "500.html",
 }
 
+// relatedPostsLimit is the maximum number of related posts shown beneath a post
+const relatedPostsLimit = 4
+
 // templateData holds common data for templates
 type templateData map[string]interface{}
 
 // baseData returns the common data for all templates
-func (s *Server) baseData() templateData {
+func (s *Server) baseData(r *http.Request) templateData {
+	span := traceStore(r, "GetNavigation")
+	defer span.End()
+
 	return templateData{
-		"BlogName": s.blogName,
-		"Tags":     s.store.GetAllTags(),
-		"Authors":  s.store.GetAllAuthors(),
-		"Pages":    s.store.GetAllPages(),
+		// Read first, so that everything the page shows is at least as new as this revision
+		"Revision":     s.store.Revision(),
+		"LastModified": s.store.LastModified(),
+		"BlogName":     s.blogName,
+		"Lang":         strings.ReplaceAll(string(s.locale), "_", "-"),
+		"Nonce":        nonceFrom(r),
+		"Tags":         s.store.GetAllTags(),
+		"Authors":      s.store.GetAllAuthors(),
+		"Pages":        s.store.GetAllPages(),
+		"SeriesNames":  s.store.GetAllSeries(),
 	}
 }
 
 // render executes the template with the given name and data
-func (s *Server) render(w http.ResponseWriter, name string, data templateData) {
-	if err := s.templates[name].Execute(w, data); err != nil {
-		log.Error("Failed to render template", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+func (s *Server) render(w http.ResponseWriter, r *http.Request, name string, data templateData) {
+	s.renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus executes the template with the given name and data, responding with the given
+// status code. The template is rendered in full before anything is written, so that a failure can
+// be answered with the error page instead of a partial page. Successful pages are served from the
+// render cache while the posts, pages and theme are unchanged, and answer conditional requests.
+func (s *Server) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data templateData) {
+	s.mu.RLock()
+	tmpl := s.templates[name]
+	themeGeneration := s.themeGeneration
+	s.mu.RUnlock()
+
+	// Error pages are not cached, as any URL may produce one
+	storeRevision, hasRevision := data["Revision"].(uint64)
+	cacheable := s.cache != nil && status == http.StatusOK && hasRevision
+	cacheKey := name + " " + r.URL.Path
+	version := renderVersion{
+		storeRevision:   storeRevision,
+		themeGeneration: themeGeneration,
 	}
+	if cacheable {
+		if page, exists := s.cache.get(cacheKey, version); exists {
+			s.writePage(w, r, status, page, data)
+			return
+		}
+	}
+
+	// Successful pages are rendered with the placeholder so that they can be tagged and cached
+	// independently of the response's nonce
+	if status == http.StatusOK {
+		data["Nonce"] = s.noncePlaceholder
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	span := traceTemplate(r, name)
+	started := time.Now()
+	err := tmpl.Execute(buf, data)
+	templateRenderDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "template execution failed")
+	}
+	span.End()
+	if err != nil {
+		log.Error("Failed to render template", "template", name, "request_id", requestIDFrom(r), "error", err)
+		if status == http.StatusInternalServerError {
+			// The error page itself failed, so fall back to plain text
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		} else {
+			s.serverError(w, r)
+		}
+		return
+	}
+
+	page := &renderedPage{Content: buf.Bytes()}
+	if status == http.StatusOK {
+		// Tag the page without the placeholder, which differs between replicas and restarts
+		page.ETag = weakETag(bytes.ReplaceAll(page.Content, []byte(s.noncePlaceholder), []byte("bloggernetes-nonce")))
+	}
+	if cacheable {
+		// The buffer is reused once this request is done, so cache a copy of the page
+		page.Content = bytes.Clone(page.Content)
+		s.cache.put(cacheKey, version, page)
+	}
+
+	s.writePage(w, r, status, page, data)
 }
 
-// NewServer creates a new HTTP server for the blog
-func NewServer(store *Store, addr string, blogName string) (*Server, error) {
-	// Initialize a map to store templates for each page
-	templates := make(map[string]*template.Template)
+// writePage writes a rendered HTML page, replacing its nonce placeholder with the response's nonce.
+// Tagged pages are validated against the request's conditional headers, using the LastModified
+// time from the page's data.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, status int, page *renderedPage, data templateData) {
+	if page.ETag != "" {
+		modified, _ := data["LastModified"].(time.Time)
+		if writeNotModified(w, r, page.ETag, modified) {
+			return
+		}
+	}
 
-	// Define the page templates to create
-	pageTemplates := []struct {
-		name     string
-		filename string
-	}{
-		{"home", "templates/home.html"},
-		{"tag", "templates/tag.html"},
-		{"author", "templates/author.html"},
-		{"post", "templates/post.html"},
-		{"page", "templates/page.html"},
+	content := page.Content
+	if bytes.Contains(content, []byte(s.noncePlaceholder)) {
+		content = bytes.ReplaceAll(content, []byte(s.noncePlaceholder), []byte(nonceFrom(r)))
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// notFound responds with the 404 page, suggesting the closest post if the request was for a post
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	data := s.baseData(r)
+	data["Title"] = "Page not found"
+	data["Path"] = r.URL.Path
+	if id, isPost := strings.CutPrefix(r.URL.Path, "/post/"); isPost {
+		span := traceStore(r, "GetClosestPost", attribute.String("post.id", id))
+		if suggestion, exists := s.store.GetClosestPost(id); exists {
+			data["Suggestion"] = suggestion
+		}
+		span.End()
+	}
+
+	s.renderStatus(w, r, http.StatusNotFound, "404", data)
+}
+
+// gone responds with the 410 page for a post that has been deleted
+func (s *Server) gone(w http.ResponseWriter, r *http.Request, deleted *DeletedPost) {
+	data := s.baseData(r)
+	data["Title"] = "Post removed"
+	data["DeletedPost"] = deleted
+
+	s.renderStatus(w, r, http.StatusGone, "410", data)
+}
+
+// serverError responds with the 500 page
+func (s *Server) serverError(w http.ResponseWriter, r *http.Request) {
+	data := s.baseData(r)
+	data["Title"] = "Something went wrong"
+
+	s.renderStatus(w, r, http.StatusInternalServerError, "500", data)
+}
+
+// NewServer creates a new HTTP server for the blog, using the renderer for Markdown in templates
+func NewServer(store *Store, renderer *Renderer, options ServerOptions) (*Server, error) {
+	// Generate the stylesheet for highlighted code blocks
+	highlightStyle, err := HighlightStyleSheet(options.CodeStyle)
+	if err != nil {
+		return nil, err
+	}
+
+	locale, err := parseLocale(options.Locale)
+	if err != nil {
+		return nil, err
+	}
+
+	timezone, err := time.LoadLocation(options.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load timezone: %w", err)
+	}
+
+	s := &Server{
+		store:          store,
+		renderer:       renderer,
+		Addr:           options.Addr,
+		blogName:       options.BlogName,
+		highlightStyle: highlightStyle,
+		mermaidURL:     options.MermaidURL,
+		mermaid:        options.Mermaid,
+		locale:         locale,
+		timezone:       timezone,
+		security:       options.Security,
+		adminAddr:      options.AdminAddr,
+		metrics:        NewMetricsHandler(store),
+		ready:          options.Ready,
+		leader:         options.Leader,
+		gitWebhook:     options.GitWebhook,
+		cache:          newRenderCache(options.RenderCacheSize),
+		images:         newImageCache(options.ImageCacheSize),
+
+		shutdownTimeout:    options.ShutdownTimeout,
+		compressionMinSize: options.CompressionMinSize,
+	}
+
+	// The placeholder is random so that it cannot be forged by the content of a post
+	placeholder, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.noncePlaceholder = "bloggernetes-nonce-" + placeholder
+
+	// Start with the embedded templates and assets
+	if err := s.SetTheme(nil); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SetTheme replaces the server's templates and assets with those of a theme, falling back to the
+// embedded defaults for any files it does not include. If the theme fails to load, the current
+// templates and assets are kept.
+func (s *Server) SetTheme(theme Theme) error {
+	// Load the static assets, including the generated stylesheet for highlighted code blocks
+	assets, err := loadAssets()
+	if err != nil {
+		return err
+	}
+	assets.add("highlight.css", s.highlightStyle)
+	for name, content := range theme {
+		if !isTemplate(name) {
+			assets.add(name, content)
+		}
+	}
+
+	// Refuse to show diagrams' sources in place of the diagrams without being asked to
+	if _, err := assets.path(mermaidAsset); err != nil && s.mermaid && s.mermaidURL == "" {
+		return fmt.Errorf("no %s to draw diagrams with: vendor it with go generate ./internal, add it to the theme, or configure its URL", mermaidAsset)
+	}
+
+	// Functions available to all templates
+	funcs := s.templateFuncs(assets)
+
 	// Read the layout template content once
-	layoutContent, err := Templates.ReadFile("templates/layout.html")
+	layoutContent, err := readTemplate(theme, "layout.html")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read layout template: %w", err)
+		return err
 	}
 
 	// Create a template for each page
-	for _, page := range pageTemplates {
-		// Create a template with the layout content
-		tmpl, err := parseTemplateWithLayout(page.name, page.filename, layoutContent)
+	templates := make(map[string]*template.Template)
+	for name, filename := range pageTemplates {
+		pageContent, err := readTemplate(theme, filename)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// Add the template to the map
-		templates[page.name] = tmpl
+		tmpl, err := parseTemplateWithLayout(name, layoutContent, pageContent, funcs)
+		if err != nil {
+			return err
+		}
+
+		templates[name] = tmpl
 	}
 
-	return &Server{
-		store:     store,
-		templates: templates,
-		Addr:      addr,
-		blogName:  blogName,
-	}, nil
+	s.mu.Lock()
+	s.templates = templates
+	s.assets = assets
+	s.themeGeneration++
+	s.mu.Unlock()
+
+	if theme != nil {
+		log.Info("Theme applied", "files", len(theme))
+	}
+	return nil
 }
 
-// parseTemplateWithLayout parses a template with the layout content
-func parseTemplateWithLayout(name, filename string, layoutContent []byte) (*template.Template, error) {
-	// Create a new template with the layout content
-	tmpl := template.New("layout.html")
-	tmpl, err := tmpl.Parse(string(layoutContent))
+// readTemplate returns the content of the named template from the theme, or the embedded
+// template if the theme does not override it
+func readTemplate(theme Theme, filename string) ([]byte, error) {
+	if content, exists := theme[filename]; exists {
+		return content, nil
+	}
+
+	content, err := Templates.ReadFile("templates/" + filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse layout template for %s: %w", name, err)
+		return nil, fmt.Errorf("failed to read %s template: %w", filename, err)
 	}
+	return content, nil
+}
 
-	// Read the page template content
-	pageContent, err := Templates.ReadFile(filename)
+// parseTemplateWithLayout parses a page template with the layout content
+func parseTemplateWithLayout(name string, layoutContent, pageContent []byte, funcs template.FuncMap) (*template.Template, error) {
+	// Create a new template with the layout content
+	tmpl := template.New("layout.html").Funcs(funcs)
+	tmpl, err := tmpl.Parse(string(layoutContent))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read %s template: %w", name, err)
+		return nil, fmt.Errorf("failed to parse layout template for %s: %w", name, err)
 	}
 
 	// Parse the page template
@@ -143,92 +451,183 @@ func parseTemplateWithLayout(name, filename string, layoutContent []byte) (*temp
 	return tmpl, nil
 }
 
-// Start starts the HTTP server
-func (s *Server) Start(ctx context.Context) error {
-	mux := s.setupRoutes()
+// Listen binds the blog's address, so that it is known to be available before anything else starts
+// and requests queue until Serve is called
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
+	}
 
+	s.listener = listener
 	s.httpServer = &http.Server{
 		Addr:    s.Addr,
-		Handler: mux,
+		Handler: s.handler(),
 	}
+	return nil
+}
 
-	// Channel to signal when the server has shut down and to communicate errors
-	serverError := make(chan error, 1)
-	serverShutdown := make(chan struct{})
+// ListenAdmin binds the admin address, if the admin routes have their own
+func (s *Server) ListenAdmin() error {
+	if s.adminAddr == "" {
+		return nil
+	}
 
-	// Start server in a goroutine
-	go func() {
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Error("Server error", "error", err)
-			serverError <- err
-		}
-		close(serverShutdown)
-	}()
+	listener, err := net.Listen("tcp", s.adminAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.adminAddr, err)
+	}
 
-	// Wait for context cancellation in a goroutine
-	go func() {
-		<-ctx.Done()
-		log.Info("Shutting down server...")
+	s.adminListener = listener
+	s.adminServer = &http.Server{
+		Addr:    s.adminAddr,
+		Handler: s.adminRoutes(http.NewServeMux()),
+	}
+	return nil
+}
 
-		// Create a timeout context for shutdown
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+// Serve serves the blog on the address bound by Listen until the context is cancelled, then stops
+// accepting requests and returns once those in progress have finished or the shutdown timeout has
+// passed
+func (s *Server) Serve(ctx context.Context) error {
+	if s.listener == nil {
+		return fmt.Errorf("server is not listening")
+	}
 
-		if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
-			log.Error("Server shutdown error", "error", err)
-		}
+	log.Info("Starting server", "address", s.listener.Addr())
+	return s.serve(ctx, s.httpServer, s.listener)
+}
+
+// ServeAdmin serves the admin routes on the address bound by ListenAdmin until the context is
+// cancelled, like Serve. It returns immediately if the admin routes are served with the blog.
+func (s *Server) ServeAdmin(ctx context.Context) error {
+	if s.adminListener == nil {
+		return nil
+	}
+
+	log.Info("Starting admin server", "address", s.adminListener.Addr())
+	return s.serve(ctx, s.adminServer, s.adminListener)
+}
+
+// serve serves HTTP requests from a listener until the context is cancelled, then shuts the server
+// down gracefully
+func (s *Server) serve(ctx context.Context, httpServer *http.Server, listener net.Listener) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.Serve(listener)
 	}()
 
-	// Check if there was an immediate error (like port already in use)
 	select {
-	case err := <-serverError:
-		return fmt.Errorf("failed to start server: %w", err)
-	case <-time.After(100 * time.Millisecond):
-		// If no error after a short delay, assume server started successfully
-		return nil
+	case err := <-serveErr:
+		return fmt.Errorf("server on %s failed: %w", listener.Addr(), err)
+	case <-ctx.Done():
 	}
+
+	// Fail readiness checks, so that no new requests are routed here while draining
+	s.stopping.Store(true)
+	log.Info("Shutting down server...", "address", listener.Addr())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server on %s gracefully: %w", listener.Addr(), err)
+	}
+
+	// Serve returns ErrServerClosed as soon as Shutdown begins
+	<-serveErr
+	return nil
+}
+
+// handler returns the HTTP handler for the blog, with its routes wrapped in middleware
+func (s *Server) handler() http.Handler {
+	return chain(s.setupRoutes(),
+		accessLog(),
+		securityHeaders(s.security),
+		compression(s.compressionMinSize),
+	)
 }
 
-// setupRoutes configures and returns the HTTP routes
+// setupRoutes configures and returns the HTTP routes, each instrumented with metrics labelled by
+// its pattern
 func (s *Server) setupRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	// Serve static files
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(Templates))))
+	// Serve static assets
+	mux.Handle(staticPrefix, instrumentRoute(staticPrefix, s.handleStatic))
+
+	// Assets such as images uploaded as BlogAssets
+	mux.Handle(blogAssetPrefix, instrumentRoute(blogAssetPrefix, s.handleBlogAsset))
 
 	// Home page - all posts
-	mux.HandleFunc("/", s.handleHome)
+	mux.Handle("/", instrumentRoute("/", s.handleHome))
 
 	// Posts by tag
-	mux.HandleFunc("/tag/", s.handleTag)
+	mux.Handle("/tag/", instrumentRoute("/tag/", s.handleTag))
 
 	// Posts by author
-	mux.HandleFunc("/author/", s.handleAuthor)
+	mux.Handle("/author/", instrumentRoute("/author/", s.handleAuthor))
+
+	// Posts in a series
+	mux.Handle("/series/", instrumentRoute("/series/", s.handleSeries))
 
 	// Individual post
-	mux.HandleFunc("/post/", s.handlePost)
+	mux.Handle("/post/", instrumentRoute("/post/", s.handlePost))
 
 	// Individual page
-	mux.HandleFunc("/page/", s.handlePage)
+	mux.Handle("/page/", instrumentRoute("/page/", s.handlePage))
 
 	// RSS feed
-	mux.HandleFunc("/rss.xml", s.handleRSS)
+	mux.Handle("/rss.xml", instrumentRoute("/rss.xml", s.handleRSS))
+
+	// Pushes to the git repository, which git hosts must reach from outside the cluster
+	if s.gitWebhook != nil {
+		mux.Handle(gitWebhookPath, instrumentRoute(gitWebhookPath, s.gitWebhook.ServeHTTP))
+	}
+
+	// Serve the admin routes alongside the blog, unless they have their own address
+	if s.adminAddr == "" {
+		s.adminRoutes(mux)
+	}
+
+	return mux
+}
+
+// adminRoutes adds the routes for operating the blog, rather than reading it, to a mux
+func (s *Server) adminRoutes(mux *http.ServeMux) *http.ServeMux {
+	// Prometheus metrics
+	mux.Handle(metricsPath, s.metrics)
+
+	// Liveness and readiness probes
+	mux.HandleFunc(healthzPath, s.handleHealthz)
+	mux.HandleFunc(readyzPath, s.handleReadyz)
 
 	return mux
 }
 
+// handleStatic handles requests for the current theme's static assets
+func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	assets := s.assets
+	s.mu.RUnlock()
+
+	assets.serve(w, r, s.notFound)
+}
+
 // handleHome handles requests to the home page
 func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		s.notFound(w, r)
 		return
 	}
 
-	data := s.baseData()
+	data := s.baseData(r)
 	data["Title"] = "Home"
+	span := traceStore(r, "GetAllPosts")
 	data["Posts"] = s.store.GetAllPosts()
+	span.End()
 
-	s.render(w, "home", data)
+	s.render(w, r, "home", data)
 }
 
 // handleTag handles requests to filter posts by tag
@@ -239,13 +638,15 @@ func (s *Server) handleTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := s.baseData()
+	data := s.baseData(r)
 	data["Title"] = fmt.Sprintf("Posts tagged with %s", tag)
 	data["Tag"] = tag
+	span := traceStore(r, "GetPostsByTag", attribute.String("tag", tag))
 	data["Posts"] = s.store.GetPostsByTag(tag)
+	span.End()
 	data["FilterBy"] = "tag"
 
-	s.render(w, "tag", data)
+	s.render(w, r, "tag", data)
 }
 
 // handleAuthor handles requests to filter posts by author
@@ -256,13 +657,34 @@ func (s *Server) handleAuthor(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := s.baseData()
+	data := s.baseData(r)
 	data["Title"] = fmt.Sprintf("Posts by %s", author)
 	data["Author"] = author
+	span := traceStore(r, "GetPostsByAuthor", attribute.String("author", author))
 	data["Posts"] = s.store.GetPostsByAuthor(author)
+	span.End()
 	data["FilterBy"] = "author"
 
-	s.render(w, "author", data)
+	s.render(w, r, "author", data)
+}
+
+// handleSeries handles requests to list the posts in a series
+func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request) {
+	series := strings.TrimPrefix(r.URL.Path, "/series/")
+	if series == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	data := s.baseData(r)
+	data["Title"] = fmt.Sprintf("Series: %s", series)
+	data["SeriesName"] = series
+	span := traceStore(r, "GetPostsInSeries", attribute.String("series", series))
+	data["Posts"] = s.store.GetPostsInSeries(series)
+	span.End()
+	data["FilterBy"] = "series"
+
+	s.render(w, r, "series", data)
 }
 
 // handlePost handles requests to view a single post
@@ -273,17 +695,34 @@ func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span := traceStore(r, "GetPost", attribute.String("post.id", id))
 	post, exists := s.store.GetPost(id)
+	span.End()
 	if !exists {
-		http.NotFound(w, r)
+		if deleted, wasDeleted := s.store.GetDeletedPost(id); wasDeleted {
+			s.gone(w, r, deleted)
+		} else {
+			s.notFound(w, r)
+		}
 		return
 	}
 
-	data := s.baseData()
+	data := s.baseData(r)
 	data["Title"] = post.Title
 	data["Post"] = post
+	if modified, exists := s.store.GetPostLastModified(post.ID); exists {
+		data["LastModified"] = modified
+	}
+	data["UsesMermaid"] = post.HasMermaid
+	span = traceStore(r, "GetRelatedPosts", attribute.String("post.id", post.ID))
+	data["PreviousPost"], data["NextPost"] = s.store.GetAdjacentPosts(post.ID)
+	data["RelatedPosts"] = s.store.GetRelatedPosts(post, relatedPostsLimit)
+	if post.Series != "" {
+		data["SeriesNav"] = NewSeriesNavigation(post, s.store.GetPostsInSeries(post.Series))
+	}
+	span.End()
 
-	s.render(w, "post", data)
+	s.render(w, r, "post", data)
 }
 
 // handlePage handles requests to view a single page
@@ -294,43 +733,52 @@ func (s *Server) handlePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span := traceStore(r, "GetPage", attribute.String("page.id", id))
 	page, exists := s.store.GetPage(id)
+	span.End()
 	if !exists {
-		http.NotFound(w, r)
+		s.notFound(w, r)
 		return
 	}
 
-	data := s.baseData()
+	data := s.baseData(r)
 	data["Title"] = page.Title
 	data["Page"] = page
 	data["PageID"] = page.ID
+	data["UsesMermaid"] = page.HasMermaid
 
-	s.render(w, "page", data)
+	s.render(w, r, "page", data)
 }
 
 // handleRSS handles requests for the RSS feed
 func (s *Server) handleRSS(w http.ResponseWriter, r *http.Request) {
+	// Read first, so that the posts are at least as new as this time
+	span := traceStore(r, "GetAllPosts")
+	lastModified := s.store.PostsLastModified()
 	posts := s.store.GetAllPosts()
-
-	// Set content type
-	w.Header().Set("Content-Type", "application/rss+xml")
+	span.End()
 
 	// Create RSS feed
 	rss := RSS{
 		Version: "2.0",
 		Channel: RSSChannel{
-			Title:         s.blogName,
-			Link:          fmt.Sprintf("http://%s", r.Host),
-			Description:   fmt.Sprintf("%s - A Kubernetes-native blog", s.blogName),
-			Language:      "en-us",
-			LastBuildDate: time.Now().Format(time.RFC1123Z),
-			Generator:     "Bloggernetes",
+			Title:       s.blogName,
+			Link:        fmt.Sprintf("http://%s", r.Host),
+			Description: fmt.Sprintf("%s - A Kubernetes-native blog", s.blogName),
+			Language:    "en-us",
+			Generator:   "Bloggernetes",
 		},
 	}
+	if !lastModified.IsZero() {
+		rss.Channel.LastBuildDate = lastModified.Format(time.RFC1123Z)
+	}
 
 	// Add items to the feed
 	for _, post := range posts {
 		description := getPostDescription(post)
+		if post.WordCount > 0 {
+			description = fmt.Sprintf("%s (%d min read, %d words)", description, post.ReadingTime, post.WordCount)
+		}
 
 		item := RSSItem{
 			Title:       post.Title,
@@ -347,13 +795,21 @@ func (s *Server) handleRSS(w http.ResponseWriter, r *http.Request) {
 	// Marshal to XML
 	output, err := xml.MarshalIndent(rss, "", "  ")
 	if err != nil {
-		log.Error("Failed to marshal RSS feed", "error", err)
+		log.Error("Failed to marshal RSS feed", "request_id", requestIDFrom(r), "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	// Add XML header
-	w.Write([]byte(xml.Header))
+	output = append([]byte(xml.Header), output...)
+
+	// Feed readers poll, so let them skip the feed when it is unchanged
+	if writeNotModified(w, r, weakETag(output), lastModified) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
 	w.Write(output)
 }
 
@@ -363,9 +819,6 @@ func getPostDescription(post *BlogPost) string {
 		return post.MetaDescription
 	}
 
-	// Use the first 200 characters of the body as description
-	if len(post.Body) > 200 {
-		return post.Body[:200] + "..."
-	}
-	return post.Body
+	// Use the start of the body's prose as description
+	return truncate(excerptLength, post.PlainText)
 }
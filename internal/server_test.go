@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server for the store with the default options, adjusted by configure
+func newTestServer(t *testing.T, store *Store, configure func(*ServerOptions)) (*Server, error) {
+	t.Helper()
+
+	renderer, err := NewRenderer(DefaultShortcodes(), DefaultHTMLPolicy, ImageOptions{})
+	if err != nil {
+		t.Fatalf("failed to create renderer: %v", err)
+	}
+	options := ServerOptions{
+		BlogName:  "Test",
+		CodeStyle: DefaultCodeStyle,
+		Locale:    DefaultLocale,
+		Timezone:  "UTC",
+	}
+	if configure != nil {
+		configure(&options)
+	}
+	return NewServer(store, renderer, options)
+}
+
+func TestServerRequiresMermaidScript(t *testing.T) {
+	_, bundleErr := Templates.ReadFile(staticDir + "/" + mermaidAsset)
+	_, err := newTestServer(t, NewStore(), func(options *ServerOptions) { options.Mermaid = true })
+	if bundleErr != nil && err == nil {
+		t.Errorf("expected the server to refuse to start without a mermaid script")
+	}
+	if bundleErr == nil && err != nil {
+		t.Errorf("failed to create server with the bundled mermaid script: %v", err)
+	}
+
+	server, err := newTestServer(t, NewStore(), func(options *ServerOptions) {
+		options.Mermaid = true
+		options.MermaidURL = "https://cdn.example.com/mermaid.min.js"
+	})
+	if err != nil {
+		t.Fatalf("failed to create server with a mermaid URL: %v", err)
+	}
+	if url := server.mermaidScriptURL(server.assets); url != "https://cdn.example.com/mermaid.min.js" {
+		t.Errorf("expected the configured mermaid URL, got %q", url)
+	}
+
+	// A theme may supply the script instead
+	server.mermaidURL = ""
+	if err := server.SetTheme(Theme{mermaidAsset: []byte("mermaid = {}")}); err != nil {
+		t.Errorf("failed to apply a theme with a mermaid script: %v", err)
+	}
+	if url := server.mermaidScriptURL(server.assets); url == "" {
+		t.Errorf("expected the theme's mermaid script to be used")
+	}
+
+	// Disabled diagrams show their sources without a script
+	server, err = newTestServer(t, NewStore(), nil)
+	if err != nil {
+		t.Fatalf("failed to create server with diagrams disabled: %v", err)
+	}
+	if url := server.mermaidScriptURL(server.assets); url != "" {
+		t.Errorf("expected no mermaid script with diagrams disabled, got %q", url)
+	}
+}
+
+func TestServerPageETagIsSharedByReplicas(t *testing.T) {
+	store := NewStore()
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.AddOrUpdatePost(ContentOwner{Source: SourceCluster, Resource: BlogPostResource, Key: "default/hello"},
+		&BlogPost{ID: "hello", Title: "Hello", AuthoredDate: modified, Modified: modified, HasMermaid: true})
+
+	// Diagrams load scripts, which carry each response's nonce
+	var etags []string
+	for range 2 {
+		server, err := newTestServer(t, store, func(options *ServerOptions) {
+			options.Mermaid = true
+			options.MermaidURL = "https://cdn.example.com/mermaid.min.js"
+		})
+		if err != nil {
+			t.Fatalf("failed to create server: %v", err)
+		}
+		response := httptest.NewRecorder()
+		server.handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/post/hello", nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", response.Code)
+		}
+		if lastModified := response.Header().Get("Last-Modified"); lastModified != modified.Format(http.TimeFormat) {
+			t.Errorf("expected the post's Last-Modified time, got %q", lastModified)
+		}
+		etags = append(etags, response.Header().Get("ETag"))
+	}
+	if etags[0] == "" || etags[0] != etags[1] {
+		t.Errorf("expected both servers to tag the page alike, got %q and %q", etags[0], etags[1])
+	}
+}
+
+func TestServerMissingAssetsUseNotFoundPage(t *testing.T) {
+	store := NewStore()
+	store.AddOrUpdateAsset(ContentOwner{Source: SourceCluster, Resource: BlogAssetResource, Key: "default/logo"},
+		&BlogAsset{Name: "logo.png", ContentType: "image/png", ETag: `"logo"`})
+	server, err := newTestServer(t, store, nil)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	for _, path := range []string{
+		staticPrefix + "missing.css",
+		blogAssetPrefix + "missing.png",
+		blogAssetPrefix + "logo.png?w=1",
+	} {
+		response := httptest.NewRecorder()
+		server.handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+		if response.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, response.Code)
+		}
+		if !strings.Contains(response.Body.String(), "Page not found - Test") {
+			t.Errorf("%s: expected the themed not found page, got %q", path, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// KindShortcode is the AST node kind for shortcodes
+var KindShortcode = ast.NewNodeKind("Shortcode")
+
+// ShortcodeContent describes what a shortcode accepts between its opening and closing tags
+type ShortcodeContent int
+
+const (
+	// ShortcodeNoContent shortcodes are self-closing: {{< youtube id="..." >}}
+	ShortcodeNoContent ShortcodeContent = iota
+	// ShortcodeMarkdownContent shortcodes wrap Markdown, which is rendered and passed as .Inner
+	ShortcodeMarkdownContent
+	// ShortcodeRawContent shortcodes wrap text that is passed through untouched as .Raw
+	ShortcodeRawContent
+)
+
+// Shortcode is a reusable component that authors embed in Markdown on a line of its own, either
+// as {{< name key="value" >}} or, for shortcodes with content, as
+// {{< name key="value" >}} ... {{< /name >}}
+type Shortcode struct {
+	Name     string
+	Required []string // Parameters that must be given
+	Content  ShortcodeContent
+	Template *template.Template
+}
+
+// ShortcodeData is passed to a shortcode's template when it is rendered
+type ShortcodeData struct {
+	Params map[string]string
+	Inner  template.HTML // Rendered Markdown content, for ShortcodeMarkdownContent shortcodes
+	Raw    string        // Unprocessed content, for ShortcodeRawContent shortcodes
+
+	images ImageOptions
+}
+
+// Param returns the named parameter, or fallback if it was not given
+func (d ShortcodeData) Param(name, fallback string) string {
+	if value, ok := d.Params[name]; ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// URL returns the named parameter like Param, rewriting references to BlogAssets such as
+// asset:diagram.png to the URLs they are served at
+func (d ShortcodeData) URL(name, fallback string) string {
+	value, _ := blogAssetURL(d.Param(name, fallback))
+	return value
+}
+
+// SrcSet returns the srcset attribute offering resized variants of the BlogAsset image named by a
+// parameter, or an empty string if the parameter names something else
+func (d ShortcodeData) SrcSet(name string) string {
+	url, isAsset := blogAssetURL(d.Param(name, ""))
+	if !isAsset || !isResizableImage(mime.TypeByExtension(path.Ext(url))) || len(d.images.Widths) == 0 {
+		return ""
+	}
+	return imageSrcSet(url, d.images.Widths)
+}
+
+// Sizes returns the sizes attribute telling browsers how wide images are shown, to accompany SrcSet
+func (d ShortcodeData) Sizes() string {
+	return d.images.Sizes
+}
+
+// ShortcodeRegistry holds the shortcodes available to authors, indexed by name
+type ShortcodeRegistry map[string]*Shortcode
+
+// Register adds a shortcode to the registry, replacing any existing shortcode with the same name
+func (r ShortcodeRegistry) Register(shortcode *Shortcode) {
+	r[shortcode.Name] = shortcode
+}
+
+// Names returns the names of the registered shortcodes, sorted alphabetically
+func (r ShortcodeRegistry) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultShortcodes returns a registry containing the built-in shortcodes
+func DefaultShortcodes() ShortcodeRegistry {
+	registry := make(ShortcodeRegistry)
+
+	// {{< callout type="warning" title="Careful" >}} Markdown {{< /callout >}}
+	registry.Register(&Shortcode{
+		Name:    "callout",
+		Content: ShortcodeMarkdownContent,
+		Template: template.Must(template.New("callout").Parse(
+			`<aside class="callout callout-{{ .Param "type" "info" }}">` +
+				`{{ with .Param "title" "" }}<p class="callout-title">{{ . }}</p>{{ end }}` +
+				`{{ .Inner }}</aside>`)),
+	})
+
+	// {{< youtube id="dQw4w9WgXcQ" title="Video title" >}}
+	registry.Register(&Shortcode{
+		Name:     "youtube",
+		Required: []string{"id"},
+		Template: template.Must(template.New("youtube").Parse(
+			`<div class="embed-video">` +
+				`<iframe src="https://www.youtube-nocookie.com/embed/{{ .Param "id" "" }}" title="{{ .Param "title" "YouTube video" }}" ` +
+				`loading="lazy" allow="encrypted-media; picture-in-picture" allowfullscreen></iframe>` +
+				`</div>`)),
+	})
+
+	// {{< gist user="octocat" id="6cad326836d38bd3a7ae" file="hello.go" >}}
+	registry.Register(&Shortcode{
+		Name:     "gist",
+		Required: []string{"user", "id"},
+		Template: template.Must(template.New("gist").Parse(
+			`<script src="https://gist.github.com/{{ .Param "user" "" }}/{{ .Param "id" "" }}.js` +
+				`{{ with .Param "file" "" }}?file={{ . }}{{ end }}"></script>`)),
+	})
+
+	// {{< figure src="asset:diagram.png" alt="Diagram" caption="How it fits together" >}}
+	registry.Register(&Shortcode{
+		Name:     "figure",
+		Required: []string{"src"},
+		Template: template.Must(template.New("figure").Parse(
+			`<figure><img src="{{ .URL "src" "" }}" alt="{{ .Param "alt" "" }}" loading="lazy"` +
+				`{{ with .SrcSet "src" }} srcset="{{ . }}" sizes="{{ $.Sizes }}"{{ end }}>` +
+				`{{ with .Param "caption" "" }}<figcaption>{{ . }}</figcaption>{{ end }}</figure>`)),
+	})
+
+	// {{< kubectl >}} manifest {{< /kubectl >}}, or {{< kubectl url="https://..." >}} {{< /kubectl >}}
+	registry.Register(&Shortcode{
+		Name:    "kubectl",
+		Content: ShortcodeRawContent,
+		Template: template.Must(template.New("kubectl").Parse(
+			`<div class="kubectl-apply"><p class="kubectl-apply-title">Apply this with kubectl</p>` +
+				`{{ with .Param "url" "" }}<pre><code>kubectl apply -f {{ . }}</code></pre>` +
+				`{{ else }}<pre><code>kubectl apply -f - &lt;&lt;'EOF'` + "\n" + `{{ .Raw }}EOF</code></pre>{{ end }}` +
+				`</div>`)),
+	})
+
+	return registry
+}
+
+// shortcodeNode is a shortcode in the document. Err is set when the shortcode cannot be rendered,
+// in which case an error is shown in its place.
+type shortcodeNode struct {
+	ast.BaseBlock
+	Name      string
+	Params    map[string]string
+	Shortcode *Shortcode
+	Err       error
+	closed    bool
+}
+
+// Kind implements ast.Node
+func (n *shortcodeNode) Kind() ast.NodeKind { return KindShortcode }
+
+// IsRaw implements ast.Node
+func (n *shortcodeNode) IsRaw() bool {
+	return n.Shortcode == nil || n.Shortcode.Content != ShortcodeMarkdownContent
+}
+
+// Dump implements ast.Node
+func (n *shortcodeNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Name": n.Name}, nil)
+}
+
+// shortcodeTag is a parsed opening or closing shortcode tag
+type shortcodeTag struct {
+	Name    string
+	Params  map[string]string
+	Closing bool
+	Err     error // Set if the tag's parameters are malformed
+}
+
+// parseShortcodeTag parses a line holding a single shortcode tag such as {{< name key="value" >}}
+// or {{< /name >}}, returning false if the line is not a shortcode tag
+func parseShortcodeTag(line []byte) (*shortcodeTag, bool) {
+	trimmed := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(trimmed, "{{<") || !strings.HasSuffix(trimmed, ">}}") {
+		return nil, false
+	}
+
+	inner := strings.TrimSpace(trimmed[3 : len(trimmed)-3])
+	if strings.HasPrefix(inner, "/") {
+		return &shortcodeTag{Name: strings.TrimSpace(inner[1:]), Closing: true}, true
+	}
+
+	name, rest, _ := strings.Cut(inner, " ")
+	if name == "" {
+		return nil, false
+	}
+
+	params, err := parseShortcodeParams(rest)
+	return &shortcodeTag{Name: name, Params: params, Err: err}, true
+}
+
+// parseShortcodeParams parses space-separated key="value" pairs; values may also be unquoted
+// if they contain no spaces
+func parseShortcodeParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, found := strings.Cut(s, "=")
+		if !found || key == "" || strings.ContainsAny(key, " \"") {
+			return nil, fmt.Errorf("expected key=\"value\" but found %q", s)
+		}
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated value for %q", key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+
+		params[key] = value
+		s = rest
+	}
+
+	return params, nil
+}
+
+// shortcodeParser parses shortcodes written on lines of their own
+type shortcodeParser struct {
+	registry ShortcodeRegistry
+}
+
+// Trigger implements parser.BlockParser
+func (p *shortcodeParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+// Open implements parser.BlockParser
+func (p *shortcodeParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	tag, ok := parseShortcodeTag(line)
+	if !ok || tag.Closing {
+		return nil, parser.NoChildren
+	}
+
+	node := &shortcodeNode{
+		Name:      tag.Name,
+		Params:    tag.Params,
+		Shortcode: p.registry[tag.Name],
+		Err:       tag.Err,
+	}
+
+	if node.Shortcode == nil {
+		node.Err = fmt.Errorf("unknown shortcode %q", tag.Name)
+	} else if node.Err == nil {
+		for _, required := range node.Shortcode.Required {
+			if node.Params[required] == "" {
+				node.Err = fmt.Errorf("shortcode %q requires the %q parameter", tag.Name, required)
+				break
+			}
+		}
+	}
+
+	// Shortcodes without content end on the line they start
+	node.closed = node.Shortcode == nil || node.Shortcode.Content == ShortcodeNoContent
+	reader.Advance(segment.Len() - trailingNewlineLength(line))
+
+	if node.IsRaw() {
+		return node, parser.NoChildren
+	}
+	return node, parser.HasChildren
+}
+
+// Continue implements parser.BlockParser
+func (p *shortcodeParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*shortcodeNode)
+	if n.closed {
+		return parser.Close
+	}
+
+	line, segment := reader.PeekLine()
+	if line == nil {
+		return parser.Close
+	}
+
+	if tag, ok := parseShortcodeTag(line); ok && tag.Closing && tag.Name == n.Name {
+		n.closed = true
+		reader.Advance(segment.Len() - trailingNewlineLength(line))
+		return parser.Close
+	}
+
+	if n.IsRaw() {
+		n.Lines().Append(segment)
+		reader.Advance(segment.Len() - trailingNewlineLength(line))
+		return parser.Continue | parser.NoChildren
+	}
+	return parser.Continue | parser.HasChildren
+}
+
+// Close implements parser.BlockParser
+func (p *shortcodeParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {
+	n := node.(*shortcodeNode)
+	if !n.closed && n.Err == nil {
+		n.Err = fmt.Errorf("shortcode %q is missing its closing {{< /%s >}}", n.Name, n.Name)
+	}
+}
+
+// CanInterruptParagraph implements parser.BlockParser
+func (p *shortcodeParser) CanInterruptParagraph() bool {
+	return true
+}
+
+// CanAcceptIndentedLine implements parser.BlockParser
+func (p *shortcodeParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// shortcodeRenderer renders shortcodes with their templates. Markdown content is rendered with
+// the same goldmark instance as the rest of the document, so it is set once that has been built.
+type shortcodeRenderer struct {
+	markdown goldmark.Markdown
+	images   ImageOptions
+}
+
+// RegisterFuncs implements renderer.NodeRenderer
+func (r *shortcodeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindShortcode, r.renderShortcode)
+}
+
+// renderShortcode renders a shortcode, or a visible error if it is invalid
+func (r *shortcodeRenderer) renderShortcode(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*shortcodeNode)
+	if n.Err != nil {
+		// Any Markdown content is still shown beneath the error so nothing the author wrote is lost
+		writeShortcodeError(w, n, n.Err)
+		return ast.WalkContinue, nil
+	}
+
+	data := ShortcodeData{Params: n.Params, images: r.images}
+	switch n.Shortcode.Content {
+	case ShortcodeMarkdownContent:
+		var inner bytes.Buffer
+		for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+			if err := r.markdown.Renderer().Render(&inner, source, child); err != nil {
+				return ast.WalkStop, err
+			}
+		}
+		// The content is still written by the author, so it is sanitized before joining the generated HTML
+		data.Inner = template.HTML(sanitizeFragment(n, inner.Bytes()))
+	case ShortcodeRawContent:
+		var raw strings.Builder
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			raw.Write(line.Value(source))
+		}
+		data.Raw = raw.String()
+	}
+
+	var out bytes.Buffer
+	if err := n.Shortcode.Template.Execute(&out, data); err != nil {
+		n.Err = fmt.Errorf("failed to render shortcode %q: %w", n.Name, err)
+		writeShortcodeError(w, n, n.Err)
+		return ast.WalkSkipChildren, nil
+	}
+
+	out.WriteByte('\n')
+	writeGenerated(w, n, out.Bytes())
+	return ast.WalkSkipChildren, nil
+}
+
+// writeShortcodeError writes a visible error in place of a shortcode
+func writeShortcodeError(w util.BufWriter, node ast.Node, err error) {
+	writeGenerated(w, node, []byte("<div class=\"shortcode-error\" role=\"alert\">"+html.EscapeString(err.Error())+"</div>\n"))
+}
+
+// shortcodeErrors returns the errors of any invalid shortcodes in the document
+func shortcodeErrors(doc ast.Node) []string {
+	var errs []string
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n, ok := node.(*shortcodeNode); ok && entering && n.Err != nil {
+			errs = append(errs, n.Err.Error())
+		}
+		return ast.WalkContinue, nil
+	})
+
+	return errs
+}
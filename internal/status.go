@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ConditionRendered is the type of the status condition reporting whether a BlogPost or BlogPage
+// was converted and rendered without problems
+const ConditionRendered = "Rendered"
+
+// Reasons for the Rendered condition
+const (
+	ReasonRenderSucceeded  = "RenderSucceeded"
+	ReasonRenderFailed     = "RenderFailed"
+	ReasonConversionFailed = "ConversionFailed"
+)
+
+// ConditionLoaded is the type of the status condition reporting whether a BlogAsset was loaded
+// and is being served
+const ConditionLoaded = "Loaded"
+
+// Reasons for the Loaded condition
+const (
+	ReasonLoadSucceeded = "LoadSucceeded"
+	ReasonLoadFailed    = "LoadFailed"
+)
+
+// statusUpdateTimeout bounds how long a status write may block an event handler
+const statusUpdateTimeout = 10 * time.Second
+
+// renderedCondition builds the Rendered condition for a resource from its conversion error, if
+// any, and the problems found while rendering it
+func renderedCondition(conversionErr error, renderErrors []string) metav1.Condition {
+	switch {
+	case conversionErr != nil:
+		return metav1.Condition{
+			Type:    ConditionRendered,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonConversionFailed,
+			Message: conversionErr.Error(),
+		}
+	case len(renderErrors) > 0:
+		return metav1.Condition{
+			Type:    ConditionRendered,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonRenderFailed,
+			Message: strings.Join(renderErrors, "; "),
+		}
+	default:
+		return metav1.Condition{
+			Type:   ConditionRendered,
+			Status: metav1.ConditionTrue,
+			Reason: ReasonRenderSucceeded,
+		}
+	}
+}
+
+// loadedCondition builds the Loaded condition for a BlogAsset from its conversion error, if any
+func loadedCondition(conversionErr error) metav1.Condition {
+	if conversionErr != nil {
+		return metav1.Condition{
+			Type:    ConditionLoaded,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonLoadFailed,
+			Message: conversionErr.Error(),
+		}
+	}
+	return metav1.Condition{
+		Type:   ConditionLoaded,
+		Status: metav1.ConditionTrue,
+		Reason: ReasonLoadSucceeded,
+	}
+}
+
+// updateCondition writes a condition to the resource's status, skipping the write if the
+// condition is already up to date so that the resulting update event settles
+func (c *Controller) updateCondition(resource schema.GroupVersionResource, obj interface{}, condition metav1.Condition) error {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("object is not an Unstructured")
+	}
+
+	condition.ObservedGeneration = unstructuredObj.GetGeneration()
+	condition.LastTransitionTime = metav1.Now()
+
+	if existing, found := findCondition(unstructuredObj, condition.Type); found {
+		if existing.Status == condition.Status &&
+			existing.Reason == condition.Reason &&
+			existing.Message == condition.Message &&
+			existing.ObservedGeneration == condition.ObservedGeneration {
+			return nil
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []metav1.Condition{condition},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal status patch: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusUpdateTimeout)
+	defer cancel()
+
+	_, err = c.client.Resource(resource).Namespace(unstructuredObj.GetNamespace()).Patch(
+		ctx, unstructuredObj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{}, "status",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to patch status of %s/%s: %w", unstructuredObj.GetNamespace(), unstructuredObj.GetName(), err)
+	}
+
+	return nil
+}
+
+// findCondition returns the condition of the given type from an unstructured object's status
+func findCondition(obj *unstructured.Unstructured, conditionType string) (metav1.Condition, bool) {
+	conditions, found, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil || !found {
+		return metav1.Condition{}, false
+	}
+
+	for _, item := range conditions {
+		fields, ok := item.(map[string]interface{})
+		if !ok || fields["type"] != conditionType {
+			continue
+		}
+
+		var condition metav1.Condition
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(fields, &condition); err != nil {
+			return metav1.Condition{}, false
+		}
+		return condition, true
+	}
+
+	return metav1.Condition{}, false
+}
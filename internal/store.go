@@ -1,36 +1,379 @@
 package internal
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-// Store is an in-memory store for blog posts and pages
+// deletedPostRetention is how long a deleted post is remembered, so that its URL is reported as
+// gone rather than never having existed
+const deletedPostRetention = 30 * 24 * time.Hour
+
+// DeletedPost records a post that was removed from the store
+type DeletedPost struct {
+	ID        string
+	Title     string
+	DeletedAt time.Time
+}
+
+// Sources of the content in the store
+const (
+	SourceCluster = "cluster" // BlogPost, BlogPage and BlogAsset resources
+	SourceGit     = "git"     // Files in the git repository
+)
+
+// ContentOwner identifies the resource or file that added a post, page or asset to the store
+type ContentOwner struct {
+	Source   string                      // SourceCluster or SourceGit
+	Resource schema.GroupVersionResource // Kind of resource it defines
+	Key      string                      // Namespace/name of the resource, or path of the file
+	Created  time.Time                   // When the resource was created, or zero for a file
+}
+
+// String describes the owner for messages
+func (o ContentOwner) String() string {
+	if o.Source == SourceGit {
+		return fmt.Sprintf("%s in the git repository", o.Key)
+	}
+	return fmt.Sprintf("%s %s", o.Resource.Resource, o.Key)
+}
+
+// is reports whether two owners are the same resource or file
+func (o ContentOwner) is(other ContentOwner) bool {
+	return o.Source == other.Source && o.Resource == other.Resource && o.Key == other.Key
+}
+
+// precedes reports whether the owner's claim to an ID wins over another's: resources in the cluster
+// win over files in the git repository, then the oldest resource wins, then the first by key
+func (o ContentOwner) precedes(other ContentOwner) bool {
+	if o.Source != other.Source {
+		return o.Source == SourceCluster
+	}
+	if !o.Created.Equal(other.Created) {
+		return o.Created.Before(other.Created)
+	}
+	return o.Key < other.Key
+}
+
+// claimKey identifies a post or page by ID, or an asset by name
+type claimKey struct {
+	resource schema.GroupVersionResource
+	id       string
+}
+
+// claim is an owner's claim to an ID, along with what it would serve under it
+type claim struct {
+	owner ContentOwner
+	value interface{} // *BlogPost, *BlogPage or *BlogAsset
+}
+
+// Store is an in-memory store for blog posts, pages and assets
 type Store struct {
-	mu    sync.RWMutex
-	posts map[string]*BlogPost // Indexed by ID
-	pages map[string]*BlogPage // Indexed by ID
+	mu      sync.RWMutex
+	posts   map[string]*BlogPost           // Indexed by ID
+	pages   map[string]*BlogPage           // Indexed by ID
+	assets  map[string]*BlogAsset          // Indexed by name
+	series  map[string]map[string]struct{} // Post IDs indexed by series name
+	deleted map[string]*DeletedPost        // Recently deleted posts indexed by ID
+
+	// Every claim to each ID, in order of precedence. The first is served, and the rest are kept
+	// so that the next can be served once it is deleted.
+	claims map[claimKey][]claim
+
+	// Functions told when one of a source's owners loses or gains an ID, by source
+	claimWatchers map[string]func(ContentOwner)
+
+	// revision is incremented by every change to the posts or pages
+	revision     uint64
+	lastModified time.Time            // When the posts or pages last changed, by their content
+	postModified map[string]time.Time // When each post last changed, indexed by ID
+	postDeleted  time.Time            // When a post was last deleted
 }
 
-// NewStore creates a new in-memory store for blog posts and pages
+// NewStore creates a new in-memory store for blog posts, pages and assets
 func NewStore() *Store {
 	return &Store{
-		posts: make(map[string]*BlogPost),
-		pages: make(map[string]*BlogPage),
+		posts:   make(map[string]*BlogPost),
+		pages:   make(map[string]*BlogPage),
+		assets:  make(map[string]*BlogAsset),
+		series:  make(map[string]map[string]struct{}),
+		deleted: make(map[string]*DeletedPost),
+		claims:  make(map[claimKey][]claim),
+
+		claimWatchers: make(map[string]func(ContentOwner)),
+		postModified:  make(map[string]time.Time),
 	}
 }
 
-// AddOrUpdatePost adds or updates a blog post in the store
-func (s *Store) AddOrUpdatePost(post *BlogPost) {
+// WatchClaims sets the function told when one of a source's owners loses its ID to another or
+// gains it back, so that it can report why. It is called without the store's lock held.
+func (s *Store) WatchClaims(source string, watcher func(ContentOwner)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.claimWatchers[source] = watcher
+}
+
+// notify tells an owner's source that it lost or gained an ID; the caller must not hold the lock
+func (s *Store) notify(owner *ContentOwner) {
+	if owner == nil {
+		return
+	}
+
+	s.mu.RLock()
+	watcher := s.claimWatchers[owner.Source]
+	s.mu.RUnlock()
+	if watcher != nil {
+		watcher(*owner)
+	}
+}
+
+// claim records an owner's claim to an ID and what it would serve under it, returning the owner now
+// holding the ID and the owner displaced by the claim, if any; the caller must hold the write lock
+func (s *Store) claim(key claimKey, owner ContentOwner, value interface{}) (holder ContentOwner, displaced *ContentOwner) {
+	claims := s.claims[key]
+	var previous *ContentOwner
+	if len(claims) > 0 {
+		previous = &claims[0].owner
+	}
+
+	updated := []claim{{owner: owner, value: value}}
+	for _, existing := range claims {
+		if !existing.owner.is(owner) {
+			updated = append(updated, existing)
+		}
+	}
+	sort.SliceStable(updated, func(i, j int) bool {
+		return updated[i].owner.precedes(updated[j].owner)
+	})
+	s.claims[key] = updated
+
+	holder = updated[0].owner
+	if previous != nil && !previous.is(holder) && !previous.is(owner) {
+		displaced = previous
+	}
+	return holder, displaced
+}
+
+// release withdraws an owner's claim to an ID, reporting whether it held the ID and returning the
+// claim that holds it instead, if any; the caller must hold the write lock
+func (s *Store) release(key claimKey, owner ContentOwner) (held bool, next *claim) {
+	claims := s.claims[key]
+	var remaining []claim
+	for i, existing := range claims {
+		if existing.owner.is(owner) {
+			held = i == 0
+		} else {
+			remaining = append(remaining, existing)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(s.claims, key)
+		return held, nil
+	}
+	s.claims[key] = remaining
+	return held, &remaining[0]
+}
+
+// conflict returns the error reporting that an ID is already held by another owner
+func conflict(key claimKey, holder ContentOwner) error {
+	if key.resource == BlogAssetResource {
+		return invalidSpec("name %q is already used by %s", key.id, holder)
+	}
+	return invalidSpec("ID %q is already used by %s", key.id, holder)
+}
+
+// AddOrUpdatePost adds or updates a blog post in the store on behalf of its owner, reporting
+// whether it changed. If another owner's claim to the ID wins, the post is kept in case that owner
+// is deleted, and an error names it.
+func (s *Store) AddOrUpdatePost(owner ContentOwner, post *BlogPost) (bool, error) {
+	key := claimKey{resource: BlogPostResource, id: post.ID}
+
+	s.mu.Lock()
+	holder, displaced := s.claim(key, owner, post)
+	changed := holder.is(owner) && s.putPost(post)
+	s.mu.Unlock()
+
+	s.notify(displaced)
+	if !holder.is(owner) {
+		return false, conflict(key, holder)
+	}
+	return changed, nil
+}
+
+// putPost adds or updates a post, reporting whether it changed; the caller must hold the write lock
+func (s *Store) putPost(post *BlogPost) bool {
+	existing, exists := s.posts[post.ID]
+	if exists {
+		// Informers redeliver unchanged resources when they resync or their status changes
+		if reflect.DeepEqual(existing, post) {
+			return false
+		}
+		s.removeFromSeries(existing)
+	}
 	s.posts[post.ID] = post
+	s.addToSeries(post)
+	delete(s.deleted, post.ID)
+	s.postModified[post.ID] = post.Modified
+	s.changed(post.Modified)
+	return true
 }
 
-// DeletePost deletes a blog post from the store
-func (s *Store) DeletePost(id string) {
+// DeletePost deletes a blog post from the store on behalf of its owner. If the owner did not hold
+// the ID, only its claim is withdrawn, and if another owner claimed it too, that owner's post is
+// served instead.
+func (s *Store) DeletePost(owner ContentOwner, id string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	held, next := s.release(claimKey{resource: BlogPostResource, id: id}, owner)
+	switch {
+	case held && next != nil:
+		s.putPost(next.value.(*BlogPost))
+	case held:
+		s.removePost(id)
+	}
+	s.mu.Unlock()
+
+	if held && next != nil {
+		s.notify(&next.owner)
+	}
+}
+
+// removePost removes a post, remembering that it was deleted; the caller must hold the write lock
+func (s *Store) removePost(id string) {
+	existing, exists := s.posts[id]
+	if !exists {
+		return
+	}
+
+	s.removeFromSeries(existing)
+	s.deleted[id] = &DeletedPost{
+		ID:        id,
+		Title:     existing.Title,
+		DeletedAt: time.Now(),
+	}
 	delete(s.posts, id)
+	delete(s.postModified, id)
+	s.postDeleted = s.deleted[id].DeletedAt
+	s.changed(s.postDeleted)
+
+	// Forget posts deleted long ago
+	for deletedID, deleted := range s.deleted {
+		if time.Since(deleted.DeletedAt) > deletedPostRetention {
+			delete(s.deleted, deletedID)
+		}
+	}
+}
+
+// changed records a change to the posts or pages made at the given time; the caller must hold the
+// write lock. Content carries the time its resource or file changed, so that every replica agrees.
+func (s *Store) changed(at time.Time) {
+	s.revision++
+	if at.After(s.lastModified) {
+		s.lastModified = at
+	}
+}
+
+// Revision returns a number that changes whenever the posts or pages change, so that anything
+// derived from them can tell when it is out of date
+func (s *Store) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
+// LastModified returns the newest time the posts or pages changed or one was deleted, or zero if
+// there are none
+func (s *Store) LastModified() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastModified
+}
+
+// GetPostLastModified returns when a post's resource or file last changed
+func (s *Store) GetPostLastModified(id string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	modified, exists := s.postModified[id]
+	return modified, exists
+}
+
+// PostsLastModified returns the newest time a post changed or was deleted, or zero if there are none
+func (s *Store) PostsLastModified() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	newest := s.postDeleted
+	for _, modified := range s.postModified {
+		if modified.After(newest) {
+			newest = modified
+		}
+	}
+	return newest
+}
+
+// GetDeletedPost returns the record of a post deleted within the retention period
+func (s *Store) GetDeletedPost(id string) (*DeletedPost, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deleted, exists := s.deleted[id]
+	if !exists || time.Since(deleted.DeletedAt) > deletedPostRetention {
+		return nil, false
+	}
+	return deleted, true
+}
+
+// GetClosestPost returns the post whose ID is most similar to the given ID, for suggesting where a
+// mistyped URL was meant to go. It returns false if no ID is within a few edits of the given ID.
+func (s *Store) GetClosestPost(id string) (*BlogPost, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Allow roughly one edit for every three characters, and at least two
+	maxDistance := max(2, len([]rune(id))/3)
+
+	var closest *BlogPost
+	closestDistance := maxDistance + 1
+	for _, post := range s.posts {
+		distance := editDistance(id, post.ID)
+		if distance < closestDistance || (distance == closestDistance && closest != nil && post.ID < closest.ID) {
+			closest = post
+			closestDistance = distance
+		}
+	}
+
+	return closest, closest != nil
+}
+
+// addToSeries adds a post to the series index; the caller must hold the write lock
+func (s *Store) addToSeries(post *BlogPost) {
+	if post.Series == "" {
+		return
+	}
+
+	ids, exists := s.series[post.Series]
+	if !exists {
+		ids = make(map[string]struct{})
+		s.series[post.Series] = ids
+	}
+	ids[post.ID] = struct{}{}
+}
+
+// removeFromSeries removes a post from the series index; the caller must hold the write lock
+func (s *Store) removeFromSeries(post *BlogPost) {
+	ids, exists := s.series[post.Series]
+	if !exists {
+		return
+	}
+
+	delete(ids, post.ID)
+	if len(ids) == 0 {
+		delete(s.series, post.Series)
+	}
 }
 
 // GetPost retrieves a blog post by ID
@@ -55,6 +398,68 @@ func (s *Store) GetAllPosts() []*BlogPost {
 	return posts
 }
 
+// GetAdjacentPosts returns the posts authored immediately before and after the specified post.
+// Either may be nil if the post is the oldest or newest, or does not exist.
+func (s *Store) GetAdjacentPosts(id string) (previous, next *BlogPost) {
+	posts := s.GetAllPosts()
+
+	for i, post := range posts {
+		if post.ID != id {
+			continue
+		}
+
+		// Posts are sorted newest first, so the previous (older) post follows this one
+		if i+1 < len(posts) {
+			previous = posts[i+1]
+		}
+		if i > 0 {
+			next = posts[i-1]
+		}
+		break
+	}
+
+	return previous, next
+}
+
+// GetRelatedPosts returns up to limit posts related to the specified post, ordered by
+// relatedness score and then by authored date (newest first)
+func (s *Store) GetRelatedPosts(post *BlogPost, limit int) []*BlogPost {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type scoredPost struct {
+		post  *BlogPost
+		score int
+	}
+
+	var candidates []scoredPost
+	for _, other := range s.posts {
+		if other.ID == post.ID {
+			continue
+		}
+		if score := RelatednessScore(post, other); score > 0 {
+			candidates = append(candidates, scoredPost{post: other, score: score})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return isNewer(candidates[i].post, candidates[j].post)
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	related := make([]*BlogPost, len(candidates))
+	for i, candidate := range candidates {
+		related[i] = candidate.post
+	}
+	return related
+}
+
 // GetPostsByTag returns all blog posts with the specified tag, sorted by authored date
 func (s *Store) GetPostsByTag(tag string) []*BlogPost {
 	s.mu.RLock()
@@ -90,7 +495,7 @@ func (s *Store) GetPostsByAuthor(author string) []*BlogPost {
 	return filtered
 }
 
-// GetAllTags returns all unique tags used in blog posts
+// GetAllTags returns all unique tags used in blog posts, sorted alphabetically
 func (s *Store) GetAllTags() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -107,10 +512,11 @@ func (s *Store) GetAllTags() []string {
 		tags = append(tags, tag)
 	}
 
+	sort.Strings(tags)
 	return tags
 }
 
-// GetAllAuthors returns all unique authors of blog posts
+// GetAllAuthors returns all unique authors of blog posts, sorted alphabetically
 func (s *Store) GetAllAuthors() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -125,21 +531,85 @@ func (s *Store) GetAllAuthors() []string {
 		authors = append(authors, author)
 	}
 
+	sort.Strings(authors)
 	return authors
 }
 
-// AddOrUpdatePage adds or updates a blog page in the store
-func (s *Store) AddOrUpdatePage(page *BlogPage) {
+// GetPostsInSeries returns all blog posts in the specified series, sorted by series order
+func (s *Store) GetPostsInSeries(series string) []*BlogPost {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.series[series]
+	posts := make([]*BlogPost, 0, len(ids))
+	for id := range ids {
+		posts = append(posts, s.posts[id])
+	}
+
+	SortBySeriesOrder(posts)
+	return posts
+}
+
+// GetAllSeries returns the names of all series, sorted alphabetically
+func (s *Store) GetAllSeries() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	series := make([]string, 0, len(s.series))
+	for name := range s.series {
+		series = append(series, name)
+	}
+
+	sort.Strings(series)
+	return series
+}
+
+// AddOrUpdatePage adds or updates a blog page in the store on behalf of its owner, reporting
+// whether it changed. As with posts, an error names the owner whose claim to the ID wins instead.
+func (s *Store) AddOrUpdatePage(owner ContentOwner, page *BlogPage) (bool, error) {
+	key := claimKey{resource: BlogPageResource, id: page.ID}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	holder, displaced := s.claim(key, owner, page)
+	changed := holder.is(owner) && s.putPage(page)
+	s.mu.Unlock()
+
+	s.notify(displaced)
+	if !holder.is(owner) {
+		return false, conflict(key, holder)
+	}
+	return changed, nil
+}
+
+// putPage adds or updates a page, reporting whether it changed; the caller must hold the write lock
+func (s *Store) putPage(page *BlogPage) bool {
+	if existing, exists := s.pages[page.ID]; exists && reflect.DeepEqual(existing, page) {
+		return false
+	}
 	s.pages[page.ID] = page
+	s.changed(page.Modified)
+	return true
 }
 
-// DeletePage deletes a blog page from the store
-func (s *Store) DeletePage(id string) {
+// DeletePage deletes a blog page from the store on behalf of its owner, serving another owner's
+// page instead if it claimed the ID too
+func (s *Store) DeletePage(owner ContentOwner, id string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.pages, id)
+	held, next := s.release(claimKey{resource: BlogPageResource, id: id}, owner)
+	switch {
+	case held && next != nil:
+		s.putPage(next.value.(*BlogPage))
+	case held:
+		if _, exists := s.pages[id]; exists {
+			delete(s.pages, id)
+			s.changed(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	if held && next != nil {
+		s.notify(&next.owner)
+	}
 }
 
 // GetPage retrieves a blog page by ID
@@ -163,3 +633,104 @@ func (s *Store) GetAllPages() []*BlogPage {
 	SortByOrder(pages)
 	return pages
 }
+
+// AddOrUpdateAsset adds or updates a blog asset in the store on behalf of its owner, reporting
+// whether it changed. As with posts, an error names the owner whose claim to the name wins instead.
+// Assets are linked by name, so changing one does not change the posts or pages.
+func (s *Store) AddOrUpdateAsset(owner ContentOwner, asset *BlogAsset) (bool, error) {
+	key := claimKey{resource: BlogAssetResource, id: asset.Name}
+
+	s.mu.Lock()
+	holder, displaced := s.claim(key, owner, asset)
+	changed := holder.is(owner) && s.putAsset(asset)
+	s.mu.Unlock()
+
+	s.notify(displaced)
+	if !holder.is(owner) {
+		return false, conflict(key, holder)
+	}
+	return changed, nil
+}
+
+// putAsset adds or updates an asset, reporting whether it changed; the caller must hold the write
+// lock
+func (s *Store) putAsset(asset *BlogAsset) bool {
+	existing, exists := s.assets[asset.Name]
+	if exists && existing.ETag == asset.ETag && existing.ContentType == asset.ContentType {
+		return false
+	}
+	// Data read from a ConfigMap can change without its resource, or an asset may carry no time
+	if asset.Modified.IsZero() || (exists && !asset.Modified.After(existing.Modified)) {
+		asset.Modified = time.Now()
+	}
+	s.assets[asset.Name] = asset
+	return true
+}
+
+// DeleteAsset deletes a blog asset from the store on behalf of its owner, serving another owner's
+// asset instead if it claimed the name too
+func (s *Store) DeleteAsset(owner ContentOwner, name string) {
+	s.mu.Lock()
+	held, next := s.release(claimKey{resource: BlogAssetResource, id: name}, owner)
+	switch {
+	case held && next != nil:
+		s.putAsset(next.value.(*BlogAsset))
+	case held:
+		delete(s.assets, name)
+	}
+	s.mu.Unlock()
+
+	if held && next != nil {
+		s.notify(&next.owner)
+	}
+}
+
+// GetAsset returns a blog asset by name
+func (s *Store) GetAsset(name string) (*BlogAsset, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	asset, exists := s.assets[name]
+	return asset, exists
+}
+
+// GetAllAssets returns all blog assets, sorted by name
+func (s *Store) GetAllAssets() []*BlogAsset {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	assets := make([]*BlogAsset, 0, len(s.assets))
+	for _, asset := range s.assets {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+	return assets
+}
+
+// editDistance returns the Levenshtein distance between two strings: the number of single character
+// insertions, deletions and substitutions needed to turn one into the other
+func editDistance(a, b string) int {
+	source, target := []rune(a), []rune(b)
+
+	// Only the previous row of the distance matrix is needed to compute the next
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreServesOldestClaimToID(t *testing.T) {
+	store := NewStore()
+	var notified []string
+	store.WatchClaims(SourceCluster, func(owner ContentOwner) {
+		notified = append(notified, owner.Key)
+	})
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := ContentOwner{Source: SourceCluster, Resource: BlogPostResource, Key: "default/older", Created: created}
+	newer := ContentOwner{Source: SourceCluster, Resource: BlogPostResource, Key: "default/newer", Created: created.Add(time.Hour)}
+
+	// The newer resource is reconciled first, then displaced by the older one
+	if _, err := store.AddOrUpdatePost(newer, &BlogPost{ID: "hello", Title: "Newer"}); err != nil {
+		t.Fatalf("failed to add newer post: %v", err)
+	}
+	if _, err := store.AddOrUpdatePost(older, &BlogPost{ID: "hello", Title: "Older"}); err != nil {
+		t.Fatalf("failed to add older post: %v", err)
+	}
+	if len(notified) != 1 || notified[0] != newer.Key {
+		t.Errorf("expected %s to be told it lost the ID, got %v", newer.Key, notified)
+	}
+	if _, err := store.AddOrUpdatePost(newer, &BlogPost{ID: "hello", Title: "Newer"}); err == nil {
+		t.Errorf("expected the newer post to conflict")
+	}
+	if post, _ := store.GetPost("hello"); post.Title != "Older" {
+		t.Errorf("expected the older post to be served, got %q", post.Title)
+	}
+
+	// Deleting the newer resource leaves the older one served
+	store.DeletePost(newer, "hello")
+	if post, exists := store.GetPost("hello"); !exists || post.Title != "Older" {
+		t.Errorf("expected the older post to still be served after deleting the newer one")
+	}
+
+	// Deleting the older resource serves the newer one again, once it is reconciled
+	store.AddOrUpdatePost(newer, &BlogPost{ID: "hello", Title: "Newer"})
+	notified = nil
+	store.DeletePost(older, "hello")
+	if post, exists := store.GetPost("hello"); !exists || post.Title != "Newer" {
+		t.Errorf("expected the newer post to be served after deleting the older one")
+	}
+	if len(notified) != 1 || notified[0] != newer.Key {
+		t.Errorf("expected %s to be told it gained the ID, got %v", newer.Key, notified)
+	}
+	if _, gone := store.GetDeletedPost("hello"); gone {
+		t.Errorf("expected the post not to be reported as deleted")
+	}
+}
+
+func TestStorePrefersClusterOverGit(t *testing.T) {
+	store := NewStore()
+	file := ContentOwner{Source: SourceGit, Resource: BlogAssetResource, Key: "assets/logo.yaml"}
+	resource := ContentOwner{Source: SourceCluster, Resource: BlogAssetResource, Key: "default/logo", Created: time.Now()}
+
+	if _, err := store.AddOrUpdateAsset(file, &BlogAsset{Name: "logo.png", ETag: `"git"`}); err != nil {
+		t.Fatalf("failed to add asset from git: %v", err)
+	}
+	if _, err := store.AddOrUpdateAsset(resource, &BlogAsset{Name: "logo.png", ETag: `"cluster"`}); err != nil {
+		t.Fatalf("failed to add asset from the cluster: %v", err)
+	}
+	if _, err := store.AddOrUpdateAsset(file, &BlogAsset{Name: "logo.png", ETag: `"git"`}); err == nil {
+		t.Errorf("expected the asset from git to conflict")
+	}
+
+	// Removing the file only withdraws its claim
+	store.DeleteAsset(file, "logo.png")
+	if asset, exists := store.GetAsset("logo.png"); !exists || asset.ETag != `"cluster"` {
+		t.Errorf("expected the asset from the cluster to still be served")
+	}
+
+	store.DeleteAsset(resource, "logo.png")
+	if _, exists := store.GetAsset("logo.png"); exists {
+		t.Errorf("expected the asset to be removed")
+	}
+}
+
+func TestStoreLastModifiedFromContent(t *testing.T) {
+	store := NewStore()
+	if modified := store.LastModified(); !modified.IsZero() {
+		t.Errorf("expected an empty store to have no last modified time, got %v", modified)
+	}
+
+	owner := ContentOwner{Source: SourceCluster, Resource: BlogPostResource, Key: "default/hello"}
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	store.AddOrUpdatePost(owner, &BlogPost{ID: "hello", Modified: newer})
+	store.AddOrUpdatePost(ContentOwner{Source: SourceCluster, Resource: BlogPostResource, Key: "default/other"}, &BlogPost{ID: "other", Modified: older})
+
+	if modified, exists := store.GetPostLastModified("other"); !exists || !modified.Equal(older) {
+		t.Errorf("expected the post's own modified time %v, got %v", older, modified)
+	}
+	if modified := store.LastModified(); !modified.Equal(newer) {
+		t.Errorf("expected the newest content's modified time %v, got %v", newer, modified)
+	}
+	if modified := store.PostsLastModified(); !modified.Equal(newer) {
+		t.Errorf("expected the newest post's modified time %v, got %v", newer, modified)
+	}
+
+	// Deleting a post forgets its time, and counts as a change itself
+	store.DeletePost(owner, "hello")
+	if _, exists := store.GetPostLastModified("hello"); exists {
+		t.Errorf("expected the deleted post's modified time to be forgotten")
+	}
+	if modified := store.PostsLastModified(); !modified.After(newer) {
+		t.Errorf("expected the deletion to be newer than %v, got %v", newer, modified)
+	}
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigMapResource defines the GVR for ConfigMaps, which may hold a theme
+var ConfigMapResource = schema.GroupVersionResource{
+	Group:    "",
+	Version:  "v1",
+	Resource: "configmaps",
+}
+
+// themePollInterval is how often a theme directory is checked for changes
+const themePollInterval = 5 * time.Second
+
+// Theme overrides the embedded templates and static assets. It is a flat set of files indexed by
+// name: those ending in .html replace the embedded template of the same name, such as layout.html
+// or post.html, and any others replace or add to the static assets, such as style.css. Files the
+// theme does not include fall back to the embedded defaults.
+type Theme map[string][]byte
+
+// Equal reports whether two themes hold the same files
+func (t Theme) Equal(other Theme) bool {
+	if len(t) != len(other) {
+		return false
+	}
+	for name, content := range t {
+		if otherContent, exists := other[name]; !exists || !bytes.Equal(content, otherContent) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTemplate reports whether a theme file is a template rather than a static asset
+func isTemplate(name string) bool {
+	return strings.HasSuffix(name, ".html")
+}
+
+// ThemeSource provides a theme and reports changes to it
+type ThemeSource interface {
+	// Watch calls apply with the current theme, and again whenever it changes, until the context
+	// is cancelled
+	Watch(ctx context.Context, apply func(Theme) error) error
+}
+
+// DirThemeSource reads a theme from the files in a directory, such as a mounted ConfigMap volume,
+// polling it for changes
+type DirThemeSource struct {
+	dir string
+}
+
+// NewDirThemeSource creates a theme source for the given directory
+func NewDirThemeSource(dir string) (*DirThemeSource, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read theme directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("theme directory %s is not a directory", dir)
+	}
+
+	return &DirThemeSource{dir: dir}, nil
+}
+
+// Watch implements ThemeSource
+func (d *DirThemeSource) Watch(ctx context.Context, apply func(Theme) error) error {
+	log.Info("Watching theme directory", "dir", d.dir)
+
+	var current Theme
+	ticker := time.NewTicker(themePollInterval)
+	defer ticker.Stop()
+
+	for {
+		theme, err := d.read()
+		if err != nil {
+			log.Error("Failed to read theme, keeping the previous theme", "dir", d.dir, "error", err)
+		} else if current == nil || !theme.Equal(current) {
+			// Only retry a theme that failed to apply once it changes again
+			current = theme
+			if err := apply(theme); err != nil {
+				log.Error("Failed to apply theme, keeping the previous theme", "dir", d.dir, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// read reads the theme's files from the directory. Hidden files are skipped, which also skips the
+// timestamped directories Kubernetes uses to update mounted ConfigMaps atomically.
+func (d *DirThemeSource) read() (Theme, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	theme := make(Theme)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		// Stat follows symlinks, which is how mounted ConfigMap files are presented
+		path := filepath.Join(d.dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		theme[entry.Name()] = content
+	}
+
+	return theme, nil
+}
+
+// ConfigMapThemeSource reads a theme from the keys of a ConfigMap, watching it for changes. Keys
+// under data and binaryData are both used as file names.
+type ConfigMapThemeSource struct {
+	client    dynamic.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapThemeSource creates a theme source for the named ConfigMap
+func NewConfigMapThemeSource(client dynamic.Interface, namespace, name string) *ConfigMapThemeSource {
+	return &ConfigMapThemeSource{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Watch implements ThemeSource
+func (c *ConfigMapThemeSource) Watch(ctx context.Context, apply func(Theme) error) error {
+	log.Info("Watching theme ConfigMap", "namespace", c.namespace, "name", c.name)
+
+	// Only watch the one ConfigMap, rather than every ConfigMap in the namespace
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+		c.client,
+		time.Minute*30,
+		c.namespace,
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = "metadata.name=" + c.name
+		},
+	)
+
+	applyObject := func(obj interface{}) {
+		theme, err := themeFromConfigMap(obj)
+		if err == nil {
+			err = apply(theme)
+		}
+		if err != nil {
+			log.Error("Failed to apply theme, keeping the previous theme", "configmap", c.name, "error", err)
+		}
+	}
+
+	informer := factory.ForResource(ConfigMapResource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: applyObject,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			applyObject(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Info("Theme ConfigMap deleted, reverting to the default theme", "configmap", c.name)
+			if err := apply(nil); err != nil {
+				log.Error("Failed to apply default theme", "error", err)
+			}
+		},
+	})
+
+	// Return only once the informer has stopped
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		informer.Run(ctx.Done())
+	}()
+	defer func() { <-stopped }()
+
+	// Syncing only fails if the context is cancelled first, when there is nothing left to do
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// themeFromConfigMap converts an unstructured ConfigMap to a Theme
+func themeFromConfigMap(obj interface{}) (Theme, error) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("object is not an Unstructured")
+	}
+
+	theme := make(Theme)
+
+	data, _, err := unstructured.NestedStringMap(unstructuredObj.Object, "data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data: %w", err)
+	}
+	for name, content := range data {
+		theme[name] = []byte(content)
+	}
+
+	binaryData, _, err := unstructured.NestedStringMap(unstructuredObj.Object, "binaryData")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read binaryData: %w", err)
+	}
+	for name, encoded := range binaryData {
+		content, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode binaryData key %s: %w", name, err)
+		}
+		theme[name] = content
+	}
+
+	return theme, nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies the blog's spans in the tracing backend
+const serviceName = "bloggernetes"
+
+// DefaultTraceSampleRatio is the fraction of requests traced when tracing is enabled, unless the
+// caller has already decided whether to trace the request
+const DefaultTraceSampleRatio = 1.0
+
+// tracerName names the instrumentation that creates the blog's spans
+const tracerName = "github.com/ashleydavies/bloggernetes/internal"
+
+// tracer creates the blog's spans. Until tracing is started it uses the global no-op provider, so
+// spans cost next to nothing when tracing is disabled.
+var tracer = otel.Tracer(tracerName)
+
+// TracingOptions configures the export of traces
+type TracingOptions struct {
+	// Endpoint is the URL of the OTLP/HTTP collector to export spans to, such as
+	// http://otel-collector:4318, or empty to disable tracing
+	Endpoint string
+
+	// SampleRatio is the fraction of requests traced
+	SampleRatio float64
+}
+
+// StartTracing exports spans to the configured collector, returning a function that flushes the
+// remaining spans and stops exporting. It does nothing if no endpoint is configured.
+func StartTracing(ctx context.Context, options TracingOptions) (func(context.Context) error, error) {
+	if options.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	if options.SampleRatio < 0 || options.SampleRatio > 1 {
+		return nil, fmt.Errorf("trace sample ratio must be between 0 and 1, got %g", options.SampleRatio)
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(options.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	// Tracers taken from the global provider only follow the first provider set, so take it again
+	// in case tracing was started before
+	tracer = provider.Tracer(tracerName)
+
+	// Continue traces begun by proxies and clients
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// startRequestSpan starts the server span of a request, continuing the trace of its caller. It is
+// named after the method until a route names it more precisely.
+func startRequestSpan(ctx context.Context, r *http.Request) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("user_agent.original", r.UserAgent()),
+		),
+	)
+}
+
+// nameRequestSpan names the span of a request after the route that matched it
+func nameRequestSpan(r *http.Request, route string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + route)
+	span.SetAttributes(attribute.String("http.route", route))
+}
+
+// endRequestSpan records the status of a response on the span of its request
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// traceStore starts a span for querying the store while answering a request; the caller must end
+// it once the query is complete
+func traceStore(r *http.Request, query string, attributes ...attribute.KeyValue) trace.Span {
+	_, span := tracer.Start(r.Context(), "Store."+query, trace.WithAttributes(attributes...))
+	return span
+}
+
+// traceTemplate starts a span for executing a template while answering a request; the caller must
+// end it once the template has been executed
+func traceTemplate(r *http.Request, name string) trace.Span {
+	_, span := tracer.Start(r.Context(), "template "+name, trace.WithAttributes(
+		attribute.String("template.name", name),
+	))
+	return span
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an OTLP/HTTP receiver recording the spans exported to it
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+// ServeHTTP implements http.Handler
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(response)
+}
+
+// span returns the recorded span with the given name, or nil if there is none
+func (c *collector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+// stringAttribute returns the value of a span's string attribute
+func stringAttribute(span *tracepb.Span, key string) string {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestTracingExportsRequestSpans(t *testing.T) {
+	received := &collector{}
+	otlp := httptest.NewServer(received)
+	defer otlp.Close()
+
+	stop, err := StartTracing(context.Background(), TracingOptions{Endpoint: otlp.URL, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("failed to start tracing: %v", err)
+	}
+
+	store := NewStore()
+	store.AddOrUpdatePost(ContentOwner{Source: SourceCluster, Key: "default/hello"}, &BlogPost{ID: "hello", Title: "Hello"})
+	renderer, err := NewRenderer(DefaultShortcodes(), DefaultHTMLPolicy, ImageOptions{})
+	if err != nil {
+		t.Fatalf("failed to create renderer: %v", err)
+	}
+	server, err := NewServer(store, renderer, ServerOptions{
+		BlogName:  "Test",
+		CodeStyle: DefaultCodeStyle,
+		Locale:    DefaultLocale,
+		Timezone:  "UTC",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	response := httptest.NewRecorder()
+	server.handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/post/hello", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", response.Code)
+	}
+
+	// Stopping flushes the batched spans to the collector
+	if err := stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop tracing: %v", err)
+	}
+
+	request := received.span("GET /post/")
+	if request == nil {
+		t.Fatalf("no request span was exported")
+	}
+	if route := stringAttribute(request, "http.route"); route != "/post/" {
+		t.Errorf("expected http.route /post/, got %q", route)
+	}
+	if request.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("expected a server span, got %v", request.Kind)
+	}
+
+	for _, name := range []string{"Store.GetPost", "template post"} {
+		child := received.span(name)
+		if child == nil {
+			t.Errorf("no %q span was exported", name)
+			continue
+		}
+		if string(child.ParentSpanId) != string(request.SpanId) {
+			t.Errorf("expected %q to be a child of the request span", name)
+		}
+	}
+}